@@ -4,4 +4,4 @@ if [[ $USE_CUSTOM_CA == "true" ]]; then
     update-ca-trust
 fi
 
-/usr/bin/terraform-repo-executor
+exec /usr/bin/terraform-repo-executor "$@"
@@ -2,87 +2,515 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/app-sre/terraform-repo-executor/pkg"
+	"github.com/app-sre/terraform-repo-executor/pkg/server"
+	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
 )
 
 // environment variables
 const (
-	ConfigFile     = "CONFIG_FILE"
-	VaultAddr      = "VAULT_ADDR"
-	VaultRoleID    = "VAULT_ROLE_ID"
-	VaultSecretID  = "VAULT_SECRET_ID"
-	WorkDir        = "WORKDIR"
-	GitlabLogRepo  = "GITLAB_LOG_REPO"
-	GitlabUsername = "GITLAB_USERNAME"
-	GitlabToken    = "GITLAB_TOKEN"
-	GitEmail       = "GIT_EMAIL"
-	TfParallelism  = "TF_PARALLELISM"
+	ConfigFile         = "CONFIG_FILE"
+	VaultAddr          = "VAULT_ADDR"
+	VaultRoleID        = "VAULT_ROLE_ID"
+	VaultSecretID      = "VAULT_SECRET_ID"
+	WorkDir            = "WORKDIR"
+	GitlabLogRepo      = "GITLAB_LOG_REPO"
+	GitlabUsername     = "GITLAB_USERNAME"
+	GitlabToken        = "GITLAB_TOKEN"
+	GitlabURL          = "GITLAB_URL"
+	GitlabReport       = "GITLAB_REPORT"
+	GitEmail           = "GIT_EMAIL"
+	GitSSHKeySecret    = "GIT_SSH_KEY_SECRET"
+	GitCredentialsFile = "GIT_CREDENTIALS_FILE"
+	GitCacheDir        = "GIT_CACHE_DIR"
+	StateSink          = "STATE_SINK"
+	StateDir           = "STATE_DIR"
+	StateS3Bucket      = "STATE_S3_BUCKET"
+	StateS3Prefix      = "STATE_S3_PREFIX"
+	StateS3Endpoint    = "STATE_S3_ENDPOINT"
+	StateS3Region      = "STATE_S3_REGION"
+	RequireSignedRef   = "REQUIRE_SIGNED_REF"
+	SigningKeysSecret  = "GIT_SIGNING_KEYS_SECRET"
+	ProtectedBranch    = "PROTECTED_BRANCH"
+	ForceRun           = "FORCE_RUN"
+	TfParallelism      = "TF_PARALLELISM"
+	MaxConcurrentRepos = "MAX_CONCURRENT_REPOS"
+	RepoTimeout        = "REPO_TIMEOUT"
+	ReportFile         = "REPORT_FILE"
+	LogFormat          = "LOG_FORMAT"
+	MetricsTextfile    = "METRICS_TEXTFILE"
+	PushgatewayURL     = "PUSHGATEWAY_URL"
+	ListenAddr         = "LISTEN_ADDR"
+	APIToken           = "API_TOKEN"
+	APITokenFile       = "API_TOKEN_FILE"
+	TfPluginCacheDir   = "TF_PLUGIN_CACHE_DIR"
 )
 
+// subcommands, running without a subcommand is the same as `run`
+const (
+	runCommand            = "run"
+	planCommand           = "plan"
+	applyCommand          = "apply"
+	validateConfigCommand = "validate-config"
+	showStateCommand      = "show-state"
+	forceUnlockCommand    = "force-unlock"
+	serveCommand          = "serve"
+	schemaCommand         = "schema"
+)
+
+var commands = []struct{ name, description string }{
+	{runCommand, "process the selected repos, planning or applying depending on `dry_run` (default)"},
+	{planCommand, "plan the selected repos regardless of `dry_run`"},
+	{applyCommand, "apply the selected repos regardless of `dry_run`"},
+	{validateConfigCommand, "check the config for problems without contacting Vault or git"},
+	{showStateCommand, "print the state of the repo selected with --repo with sensitive values masked"},
+	{forceUnlockCommand, "release a stuck state lock of the repo selected with --repo: force-unlock --repo NAME LOCK_ID"},
+	{serveCommand, "accept configs as jobs over HTTP"},
+	{schemaCommand, "print the JSON Schema of the config"},
+}
+
+// settings are read from environment variables and can be overridden with flags. Secrets can only be
+// supplied as environment variables so that they don't show up in the process list
+type settings struct {
+	cfgPath            string
+	workdir            string
+	vaultAddr          string
+	gitlabLogRepo      string
+	gitlabUsername     string
+	gitEmail           string
+	gitlabURL          string
+	gitlabReport       bool
+	sshKeySecret       string
+	gitCredentialsFile string
+	gitCacheDir        string
+	stateSink          string
+	stateDir           string
+	stateS3Bucket      string
+	stateS3Prefix      string
+	stateS3Endpoint    string
+	stateS3Region      string
+	requireSignedRef   bool
+	signingKeysSecret  string
+	protectedBranch    string
+	force              bool
+	tfParallelism      int
+	maxConcurrentRepos int
+	repoTimeout        time.Duration
+	reportFile         string
+	logFormat          string
+	metricsTextfile    string
+	pushgatewayURL     string
+	listenAddr         string
+	apiTokenFile       string
+	repos              repoNames
+}
+
+// repoNames collects every --repo flag
+type repoNames []string
+
+func (r *repoNames) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *repoNames) Set(name string) error {
+	*r = append(*r, name)
+	return nil
+}
+
 func main() {
+	command := runCommand
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() { usage(fs) }
+	s, err := registerFlags(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !slices.ContainsFunc(commands, func(c struct{ name, description string }) bool { return c.name == command }) {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", command)
+		usage(fs)
+		os.Exit(2)
+	}
+	// exits on invalid flags
+	_ = fs.Parse(args)
+
+	// the schema is printed without any log lines so that the output can be redirected to a file
+	if command == schemaCommand {
+		printSchema()
+		return
+	}
+
 	// Generate unique session ID for Vector log tracking
 	sessionID := fmt.Sprintf("session-%d", time.Now().UnixNano())
 
-	log.Printf("Starting terraform-repo-executor [%s]", sessionID)
+	logger, err := pkg.NewLogger(os.Stdout, s.logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// every line includes the session ID so that Vector can group the lines of a run
+	slog.SetDefault(logger.With("session_id", sessionID))
 
-	cfgPath := getEnvOrDefault(ConfigFile, "/config.yaml")
-	workdir := getEnvOrDefault(WorkDir, "/tmp/tf-repo")
-	vaultAddr := getEnvOrError(VaultAddr)
-	roleID := getEnvOrError(VaultRoleID)
-	secretID := getEnvOrError(VaultSecretID)
-	gitlabLogRepo := getEnvOrError(GitlabLogRepo)
-	gitlabUsername := getEnvOrError(GitlabUsername)
-	gitlabToken := getEnvOrError(GitlabToken)
-	gitEmail := getEnvOrError(GitEmail)
-	tfParallelism := getEnvOrDefault(TfParallelism, "10")
+	slog.Info("Starting terraform-repo-executor", "command", command)
 
-	tfParallelismInt, err := strconv.Atoi(tfParallelism)
-	if err != nil {
-		log.Fatal("Integer value required for `TF_PARALLELISM` environment variable")
+	if s.maxConcurrentRepos < 1 {
+		fatal("Positive integer value required for `MAX_CONCURRENT_REPOS` environment variable")
 	}
+	if s.repoTimeout <= 0 {
+		fatal("Positive duration value (e.g. `45m`) required for `REPO_TIMEOUT` environment variable")
+	}
+
+	// SIGTERM/SIGINT interrupt running terraform processes so they can release their state locks
+	// before the remaining repositories are skipped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		slog.Warn("Received signal, interrupting running terraform operations", "signal", sig.String())
+		cancel()
+	}()
 
-	err = pkg.Run(cfgPath,
-		workdir,
-		vaultAddr,
-		roleID,
-		secretID,
-		gitlabLogRepo,
-		gitlabUsername,
-		gitlabToken,
-		gitEmail,
-		tfParallelismInt,
-	)
+	switch command {
+	case serveCommand:
+		runServer(ctx, s)
+		return
+	case validateConfigCommand:
+		err = validateConfig(s)
+	case showStateCommand:
+		err = showState(ctx, s)
+	case forceUnlockCommand:
+		err = forceUnlock(ctx, s, fs.Args())
+	default:
+		err = run(ctx, s, command)
+	}
 
 	// sleep to let vector flush logs
 	time.Sleep(2 * time.Second)
 
 	if err != nil {
-		log.Printf("Error: %v [%s]", err, sessionID)
+		slog.Error("Run failed", "error", err)
 		os.Exit(1)
 	}
-	log.Printf("Completed successfully [%s]", sessionID)
+	slog.Info("Completed successfully")
 	os.Exit(0)
 }
 
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(out, "\nFlags override the environment variable named in their description:\n")
+	fs.PrintDefaults()
+}
+
+// registers all flags with the values of their environment variables as defaults
+func registerFlags(fs *flag.FlagSet) (*settings, error) {
+	s := &settings{}
+
+	tfParallelism, err := strconv.Atoi(getEnvOrDefault(TfParallelism, "10"))
+	if err != nil {
+		return nil, errors.New("integer value required for `TF_PARALLELISM` environment variable")
+	}
+	maxConcurrentRepos, err := strconv.Atoi(getEnvOrDefault(MaxConcurrentRepos, "1"))
+	if err != nil {
+		return nil, errors.New("positive integer value required for `MAX_CONCURRENT_REPOS` environment variable")
+	}
+	repoTimeout, err := time.ParseDuration(getEnvOrDefault(RepoTimeout, "1h"))
+	if err != nil {
+		return nil, errors.New("positive duration value (e.g. `45m`) required for `REPO_TIMEOUT` environment variable")
+	}
+	requireSignedRef, err := strconv.ParseBool(getEnvOrDefault(RequireSignedRef, "false"))
+	if err != nil {
+		return nil, errors.New("boolean value (`true` or `false`) required for `REQUIRE_SIGNED_REF` environment variable")
+	}
+	force, err := strconv.ParseBool(getEnvOrDefault(ForceRun, "false"))
+	if err != nil {
+		return nil, errors.New("boolean value (`true` or `false`) required for `FORCE_RUN` environment variable")
+	}
+	gitlabReport, err := strconv.ParseBool(getEnvOrDefault(GitlabReport, "false"))
+	if err != nil {
+		return nil, errors.New("boolean value (`true` or `false`) required for `GITLAB_REPORT` environment variable")
+	}
+
+	fs.StringVar(&s.cfgPath, "config", getEnvOrDefault(ConfigFile, "/config.yaml"), "input/config file location ("+ConfigFile+")")
+	fs.StringVar(&s.workdir, "workdir", getEnvOrDefault(WorkDir, "/tmp/tf-repo"), "working directory for tf operations ("+WorkDir+")")
+	fs.StringVar(&s.vaultAddr, "vault-addr", os.Getenv(VaultAddr), "address of the Vault instance ("+VaultAddr+")")
+	fs.StringVar(&s.gitlabLogRepo, "log-repo", os.Getenv(GitlabLogRepo), "repo the state is pushed to ("+GitlabLogRepo+")")
+	fs.StringVar(&s.gitlabUsername, "gitlab-username", os.Getenv(GitlabUsername), "username for cloning and pushing ("+GitlabUsername+")")
+	fs.StringVar(&s.gitEmail, "git-email", os.Getenv(GitEmail), "email to associate commits with ("+GitEmail+")")
+	fs.StringVar(&s.gitlabURL, "gitlab-url", os.Getenv(GitlabURL), "GitLab instance plans and results are posted to, e.g. https://gitlab.example.com ("+GitlabURL+")")
+	fs.BoolVar(&s.gitlabReport, "gitlab-report", gitlabReport, "post commit statuses and a merge request summary to GitLab ("+GitlabReport+")")
+	fs.StringVar(&s.sshKeySecret, "ssh-key-secret", os.Getenv(GitSSHKeySecret), "vault path of the SSH key for repos cloned over SSH ("+GitSSHKeySecret+")")
+	fs.StringVar(&s.gitCredentialsFile, "git-credentials", os.Getenv(GitCredentialsFile), "file mapping git hosts to credentials in vault ("+GitCredentialsFile+")")
+	fs.StringVar(&s.gitCacheDir, "git-cache-dir", os.Getenv(GitCacheDir), "directory of the clone cache kept across runs ("+GitCacheDir+")")
+	fs.StringVar(&s.stateSink, "state-sink", getEnvOrDefault(StateSink, pkg.StateSinkGit), "where state is written to: git, dir or s3 ("+StateSink+")")
+	fs.StringVar(&s.stateDir, "state-dir", os.Getenv(StateDir), "directory the dir state sink writes to ("+StateDir+")")
+	fs.StringVar(&s.stateS3Bucket, "state-s3-bucket", os.Getenv(StateS3Bucket), "bucket the s3 state sink writes to ("+StateS3Bucket+")")
+	fs.StringVar(&s.stateS3Prefix, "state-s3-prefix", os.Getenv(StateS3Prefix), "key prefix of the s3 state sink ("+StateS3Prefix+")")
+	fs.StringVar(&s.stateS3Endpoint, "state-s3-endpoint", os.Getenv(StateS3Endpoint), "S3 compatible endpoint, defaults to AWS ("+StateS3Endpoint+")")
+	fs.StringVar(&s.stateS3Region, "state-s3-region", os.Getenv(StateS3Region), "region of the s3 state sink bucket ("+StateS3Region+")")
+	fs.BoolVar(&s.requireSignedRef, "require-signed-ref", requireSignedRef, "only plan and apply commits signed with an allowed key ("+RequireSignedRef+")")
+	fs.StringVar(&s.signingKeysSecret, "signing-keys-secret", os.Getenv(SigningKeysSecret), "vault path of the keys commits may be signed with ("+SigningKeysSecret+")")
+	fs.StringVar(&s.protectedBranch, "protected-branch", os.Getenv(ProtectedBranch), "only apply commits reachable from this branch ("+ProtectedBranch+")")
+	fs.BoolVar(&s.force, "force", force, "process repos even if nothing changed since their last apply ("+ForceRun+")")
+	fs.IntVar(&s.tfParallelism, "tf-parallelism", tfParallelism, "concurrent terraform operations ("+TfParallelism+")")
+	fs.IntVar(&s.maxConcurrentRepos, "max-concurrent-repos", maxConcurrentRepos, "repos processed at the same time ("+MaxConcurrentRepos+")")
+	fs.DurationVar(&s.repoTimeout, "repo-timeout", repoTimeout, "default timeout of a single repo ("+RepoTimeout+")")
+	fs.StringVar(&s.reportFile, "report-file", os.Getenv(ReportFile), "path to write a JSON report of the run to ("+ReportFile+")")
+	fs.StringVar(&s.logFormat, "log-format", getEnvOrDefault(LogFormat, pkg.LogFormatJSON), "json or text ("+LogFormat+")")
+	fs.StringVar(&s.metricsTextfile, "metrics-textfile", os.Getenv(MetricsTextfile), "path to write metrics to ("+MetricsTextfile+")")
+	fs.StringVar(&s.pushgatewayURL, "pushgateway-url", os.Getenv(PushgatewayURL), "Pushgateway to push metrics to ("+PushgatewayURL+")")
+	fs.StringVar(&s.listenAddr, "listen-addr", getEnvOrDefault(ListenAddr, "127.0.0.1:8080"), "address the HTTP API listens on in serve mode ("+ListenAddr+")")
+	fs.StringVar(&s.apiTokenFile, "api-token-file", os.Getenv(APITokenFile), "file with the bearer token of the HTTP API, replaces "+APIToken+" ("+APITokenFile+")")
+	fs.Var(&s.repos, "repo", "only process the repo with this name, can be repeated")
+
+	return s, nil
+}
+
+// builds the executor options, the state sink is only required by commands that write state
+func (s *settings) options(requireStateSink bool) pkg.Options {
+	opts := pkg.Options{
+		Workdir:            s.workdir,
+		VaultAddr:          required(s.vaultAddr, VaultAddr),
+		VaultRoleID:        getEnvOrError(VaultRoleID),
+		VaultSecretID:      getEnvOrError(VaultSecretID),
+		GitlabUsername:     s.gitlabUsername,
+		SSHKeySecret:       s.sshKeySecret,
+		GitCacheDir:        s.gitCacheDir,
+		GitlabURL:          s.gitlabURL,
+		GitlabReport:       s.gitlabReport,
+		StateSink:          s.stateSink,
+		RequireSignedRef:   s.requireSignedRef,
+		SigningKeysSecret:  s.signingKeysSecret,
+		ProtectedBranch:    s.protectedBranch,
+		Force:              s.force,
+		TfParallelism:      s.tfParallelism,
+		TfPluginCacheDir:   os.Getenv(TfPluginCacheDir),
+		MaxConcurrentRepos: s.maxConcurrentRepos,
+		RepoTimeout:        s.repoTimeout,
+		ReportFile:         s.reportFile,
+		MetricsTextfile:    s.metricsTextfile,
+		PushgatewayURL:     s.pushgatewayURL,
+	}
+	if s.sshKeySecret != "" {
+		err := vaultutil.ValidatePath(s.sshKeySecret)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid `%s`: %s", GitSSHKeySecret, err))
+		}
+	}
+	if s.protectedBranch != "" {
+		err := pkg.ValidateBranchName(s.protectedBranch)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid `%s`: %s", ProtectedBranch, err))
+		}
+	}
+	if s.signingKeysSecret != "" {
+		err := vaultutil.ValidatePath(s.signingKeysSecret)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid `%s`: %s", SigningKeysSecret, err))
+		}
+	}
+	// for git the GitLab token is only used when no per host credentials are configured, it's still used for the
+	// GitLab API
+	opts.GitlabToken = os.Getenv(GitlabToken)
+	if s.gitCredentialsFile != "" {
+		creds, err := pkg.LoadGitCredentials(s.gitCredentialsFile)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid `%s`: %s", GitCredentialsFile, err))
+		}
+		opts.GitCredentials = creds
+	}
+	if requireStateSink {
+		switch s.stateSink {
+		case pkg.StateSinkGit:
+			opts.GitlabLogRepo = required(s.gitlabLogRepo, GitlabLogRepo)
+			opts.GitEmail = required(s.gitEmail, GitEmail)
+			opts.GitlabUsername = required(s.gitlabUsername, GitlabUsername)
+			if s.gitCredentialsFile == "" {
+				opts.GitlabToken = getEnvOrError(GitlabToken)
+			}
+		case pkg.StateSinkDir:
+			opts.StateDir = required(s.stateDir, StateDir)
+		case pkg.StateSinkS3:
+			opts.StateS3Bucket = required(s.stateS3Bucket, StateS3Bucket)
+			opts.StateS3Prefix = s.stateS3Prefix
+			opts.StateS3Endpoint = s.stateS3Endpoint
+			opts.StateS3Region = s.stateS3Region
+		default:
+			fatal(fmt.Sprintf("Invalid `%s`: unknown state sink '%s'", StateSink, s.stateSink))
+		}
+	}
+	return opts
+}
+
+// loads the config and applies the --repo filters
+func (s *settings) loadConfig() (*pkg.Input, error) {
+	cfg, err := pkg.LoadConfig(s.cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.FilterRepos(cfg, s.repos)
+}
+
+// returns the name of the single repo selected with --repo
+func (s *settings) singleRepo(command string) string {
+	if len(s.repos) != 1 {
+		fatal(fmt.Sprintf("`%s` requires exactly one --repo", command))
+	}
+	return s.repos[0]
+}
+
+// processes the selected repos, plan and apply override dry_run from the config
+func run(ctx context.Context, s *settings, command string) error {
+	opts := s.options(true)
+	cfg, err := s.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case planCommand:
+		cfg.DryRun = true
+	case applyCommand:
+		cfg.DryRun = false
+	}
+
+	_, err = pkg.RunInput(ctx, slog.Default(), cfg, opts)
+	return err
+}
+
+func validateConfig(s *settings) error {
+	cfg, err := s.loadConfig()
+	if err != nil {
+		return err
+	}
+	err = pkg.ValidateInput(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Config is valid", "path", s.cfgPath, "repos", len(cfg.Repos))
+	return nil
+}
+
+func showState(ctx context.Context, s *settings) error {
+	name := s.singleRepo(showStateCommand)
+	opts := s.options(false)
+	cfg, err := s.loadConfig()
+	if err != nil {
+		return err
+	}
+	// the state is written to stderr so that it is not interleaved with the log lines on stdout
+	return pkg.ShowState(ctx, slog.Default(), cfg, name, opts, os.Stderr)
+}
+
+func forceUnlock(ctx context.Context, s *settings, args []string) error {
+	name := s.singleRepo(forceUnlockCommand)
+	if len(args) != 1 {
+		fatal("`force-unlock` requires the lock ID as its only argument")
+	}
+	opts := s.options(false)
+	cfg, err := s.loadConfig()
+	if err != nil {
+		return err
+	}
+	return pkg.ForceUnlock(ctx, slog.Default(), cfg, name, args[0], opts)
+}
+
+func printSchema() {
+	schema, err := pkg.Schema()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(schema)
+}
+
+// runs jobs submitted over HTTP until a signal cancels ctx
+func runServer(ctx context.Context, s *settings) {
+	opts := s.options(true)
+
+	// repos are only fetched once per job while the history they share stays cached across jobs
+	if opts.GitCacheDir == "" {
+		opts.GitCacheDir = filepath.Join(s.workdir, "git-cache")
+	}
+
+	// providers downloaded by one job are reused by the following ones when a plugin cache is configured
+	if opts.TfPluginCacheDir != "" {
+		err := os.MkdirAll(opts.TfPluginCacheDir, pkg.FolderPerm)
+		if err != nil {
+			fatal(fmt.Sprintf("Unable to create `TF_PLUGIN_CACHE_DIR`: %s", err))
+		}
+	}
+
+	srv := server.New(slog.Default(), server.Options{Executor: opts, Token: s.apiToken()}, pkg.RunInput)
+	err := srv.ListenAndServe(ctx, s.listenAddr)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(fmt.Sprintf("Server failed: %s", err))
+	}
+	slog.Info("Server stopped")
+}
+
+// returns the bearer token the HTTP API requires, read from API_TOKEN_FILE or API_TOKEN
+func (s *settings) apiToken() string {
+	if s.apiTokenFile == "" {
+		return required(os.Getenv(APIToken), APIToken+" or "+APITokenFile)
+	}
+	raw, err := os.ReadFile(s.apiTokenFile)
+	if err != nil {
+		fatal(fmt.Sprintf("Unable to read `%s`: %s", APITokenFile, err))
+	}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		fatal(fmt.Sprintf("`%s` is empty", APITokenFile))
+	}
+	return token
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
-		log.Printf("%s not set. Using default value: `%s`", key, defaultValue)
 		return defaultValue
 	}
 	return value
 }
 
 func getEnvOrError(key string) string {
-	value := os.Getenv(key)
+	return required(os.Getenv(key), key)
+}
+
+// exits when a required setting was supplied neither as flag nor as environment variable
+func required(value, key string) string {
 	if value == "" {
-		log.Fatalf("%s is required", key)
+		fatal(fmt.Sprintf("%s is required", key))
 	}
 	return value
 }
+
+func fatal(msg string) {
+	slog.Error(msg)
+	os.Exit(1)
+}
@@ -0,0 +1,577 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// refspecs of a full clone, equivalent to what `git clone` fetches
+const (
+	allBranchesRefSpec = "+refs/heads/*:refs/remotes/origin/*"
+	allTagsRefSpec     = "+refs/tags/*:refs/tags/*"
+)
+
+// cloneCache keeps one bare repository per repository URL that every repo with that URL fetches into,
+// so that a monorepo used by several repos is only fetched once per run. Each repo gets its own
+// worktree whose objects are shared with the cached repository rather than copied
+type cloneCache struct {
+	dir       string
+	temporary bool
+
+	mu   sync.Mutex
+	urls map[string]*cachedRepo
+}
+
+// cachedRepo is the bare repository of a single URL, mu serializes fetching into it
+type cachedRepo struct {
+	mu   sync.Mutex
+	repo *git.Repository
+	// refs already fetched during this run and whether the full history was fetched
+	fetched     map[string]bool
+	fullFetched bool
+	// branches whose full history was fetched during this run
+	historyFetched map[string]bool
+}
+
+// opens the clone cache in dir, which is kept when closing the cache so that later runs only need to
+// fetch new commits. Without dir the cache is created in a temporary directory that is removed on close
+func openCloneCache(dir string) (*cloneCache, error) {
+	c := &cloneCache{
+		dir:  dir,
+		urls: map[string]*cachedRepo{},
+	}
+	var err error
+	if dir == "" {
+		c.dir, err = os.MkdirTemp("", "tf-repo-git-cache")
+		c.temporary = true
+	} else {
+		err = os.MkdirAll(dir, FolderPerm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// removes the cache directory if it's temporary
+func (c *cloneCache) close() error {
+	if c.temporary {
+		return os.RemoveAll(c.dir)
+	}
+	return nil
+}
+
+// returns the cached bare repository of url, creating it if it doesn't exist yet
+func (c *cloneCache) open(url string) (*cachedRepo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.urls[url]; ok {
+		return cached, nil
+	}
+
+	// the URL may contain characters that aren't valid in paths
+	dir := filepath.Join(c.dir, fmt.Sprintf("%x.git", sha256.Sum256([]byte(url))))
+	repo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(dir, true)
+		if err == nil {
+			_, err = repo.CreateRemote(&config.RemoteConfig{
+				Name: git.DefaultRemoteName,
+				URLs: []string{url},
+			})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cached repository of '%s': %w", url, err)
+	}
+
+	cached := &cachedRepo{
+		repo:           repo,
+		fetched:        map[string]bool{},
+		historyFetched: map[string]bool{},
+	}
+	c.urls[url] = cached
+	return cached, nil
+}
+
+// clones the repository into dir and checks out its ref, returning the checked out commit.
+// Only the commit the ref points to is fetched into the cache, servers that don't allow fetching it fall
+// back to fetching the full history. Abbreviated SHAs can only be resolved with the full history so
+// they're always fully fetched
+func (c *cloneCache) cloneRepo(ctx context.Context, r Repo, dir string, auth transport.AuthMethod, logger *slog.Logger) (*object.Commit, error) {
+	// go-git doesn't create a new directory in the cloned dir so we have to create one ourselves
+	err := os.Mkdir(dir, FolderPerm)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkout(ctx, r, dir, auth, logger)
+}
+
+// checks out the ref of r into the existing directory dir
+func (c *cloneCache) checkout(ctx context.Context, r Repo, dir string, auth transport.AuthMethod, logger *slog.Logger) (*object.Commit, error) {
+	cached, err := c.open(r.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	sha, sparseDirs, err := cached.resolve(ctx, r, auth, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := initWorktree(dir, cached.repo)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{r.URL},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	err = wt.Checkout(&git.CheckoutOptions{
+		Hash:                      sha,
+		SparseCheckoutDirectories: sparseDirs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(sha)
+}
+
+// fetches the ref of r into the cached repository unless that already happened during this run and
+// resolves it, also returns the directories to check out if r uses sparse checkout
+func (cr *cachedRepo) resolve(ctx context.Context, r Repo, auth transport.AuthMethod, logger *slog.Logger) (plumbing.Hash, []string, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	remote, err := cr.repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	switch {
+	case cr.fetched[r.Ref] || cr.fullFetched:
+		logger.Info("Using cached repository")
+	case commitSHARegexp.MatchString(r.Ref) && hasCommit(cr.repo, r.Ref):
+		// commits never change, a cache kept across runs doesn't need to fetch them again
+		logger.Info("Using cached commit")
+	case shortSHARegexp.MatchString(r.Ref):
+		err = fullFetch(ctx, cr.repo, remote, auth)
+		cr.fullFetched = err == nil
+	default:
+		err = shallowFetch(ctx, cr.repo, remote, r.Ref, auth)
+		if err != nil && ctx.Err() == nil && !errors.As(err, new(refNotFoundError)) {
+			logger.Warn("Unable to fetch only the target commit, fetching the full history instead", "error", err)
+			err = fullFetch(ctx, cr.repo, remote, auth)
+			cr.fullFetched = err == nil
+		}
+	}
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	cr.fetched[r.Ref] = true
+
+	sha, err := resolveRef(cr.repo, r.Ref)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	var sparseDirs []string
+	if r.SparseCheckout {
+		sparseDirs, err = sparseCheckoutDirs(cr.repo, sha, r.Path)
+		if err != nil {
+			return plumbing.ZeroHash, nil, err
+		}
+		logger.Info("Using sparse checkout", "dirs", sparseDirs)
+	}
+	return sha, sparseDirs, nil
+}
+
+// verifies that commit is part of the history of branch, so that e.g. only commits merged into a protected
+// branch are applied rather than any commit pushed to the repository. The full history of the branch is
+// fetched once per run for this
+func (c *cloneCache) checkReachable(ctx context.Context, r Repo, commit *object.Commit, branch string, auth transport.AuthMethod) error {
+	cached, err := c.open(r.URL)
+	if err != nil {
+		return err
+	}
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	if !cached.historyFetched[branch] && !cached.fullFetched {
+		remote, err := cached.repo.Remote(git.DefaultRemoteName)
+		if err != nil {
+			return err
+		}
+		err = fetchBranchHistory(ctx, cached.repo, remote, branch, auth)
+		if errors.Is(err, git.NoMatchingRefSpecError{}) {
+			return fmt.Errorf("protected branch '%s' does not exist", branch)
+		}
+		if err != nil {
+			return err
+		}
+		cached.historyFetched[branch] = true
+	}
+
+	tip, err := peeledRef(cached.repo, plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch))
+	if err != nil {
+		return err
+	}
+	if tip == plumbing.ZeroHash {
+		return fmt.Errorf("protected branch '%s' does not exist", branch)
+	}
+	// the commit is read from the cached repository as it has the history of the branch
+	reachable, err := commitIsAncestor(cached.repo, commit.Hash, tip)
+	if err != nil {
+		return fmt.Errorf("unable to walk the history of protected branch '%s': %w", branch, err)
+	}
+	if !reachable {
+		return fmt.Errorf("commit %s is not reachable from protected branch '%s'", commit.Hash, branch)
+	}
+	return nil
+}
+
+// whether commit is an ancestor of the commit with the full SHA other, the full history is fetched if the
+// history between them is missing. False is returned if other is not part of the repository at all, e.g.
+// because the history was rewritten since
+func (c *cloneCache) isAncestor(ctx context.Context, r Repo, commit *object.Commit, other string, auth transport.AuthMethod) (bool, error) {
+	cached, err := c.open(r.URL)
+	if err != nil {
+		return false, err
+	}
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	if !cached.fullFetched {
+		ancestor, err := commitIsAncestor(cached.repo, commit.Hash, plumbing.NewHash(other))
+		if err == nil {
+			return ancestor, nil
+		}
+		remote, err := cached.repo.Remote(git.DefaultRemoteName)
+		if err != nil {
+			return false, err
+		}
+		err = fullFetch(ctx, cached.repo, remote, auth)
+		if err != nil {
+			return false, err
+		}
+		cached.fullFetched = true
+	}
+
+	if !hasCommit(cached.repo, other) {
+		return false, nil
+	}
+	return commitIsAncestor(cached.repo, commit.Hash, plumbing.NewHash(other))
+}
+
+// whether the files checked out for r differ between commit and the commit with the full SHA other, i.e.
+// project_path or any local module it uses changed, or anything in the repo if they refer to other files with
+// `..`. The full history is fetched if other is missing, and a commit that doesn't exist anymore counts as changed
+func (c *cloneCache) changedSince(ctx context.Context, r Repo, commit *object.Commit, other string, auth transport.AuthMethod) (bool, error) {
+	cached, err := c.open(r.URL)
+	if err != nil {
+		return false, err
+	}
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	if !hasCommit(cached.repo, other) && !cached.fullFetched {
+		remote, err := cached.repo.Remote(git.DefaultRemoteName)
+		if err != nil {
+			return false, err
+		}
+		err = fullFetch(ctx, cached.repo, remote, auth)
+		if err != nil {
+			return false, err
+		}
+		cached.fullFetched = true
+	}
+	if !hasCommit(cached.repo, other) {
+		return true, nil
+	}
+
+	// the local modules used by the new commit are compared, a change of the modules project_path uses
+	// means that project_path itself changed
+	dirs, err := sparseCheckoutDirs(cached.repo, commit.Hash, r.Path)
+	if err != nil {
+		return false, err
+	}
+	if dirs == nil {
+		dirs = []string{""}
+	}
+	newTree, err := commit.Tree()
+	if err != nil {
+		return false, err
+	}
+	otherCommit, err := cached.repo.CommitObject(plumbing.NewHash(other))
+	if err != nil {
+		return false, err
+	}
+	oldTree, err := otherCommit.Tree()
+	if err != nil {
+		return false, err
+	}
+	for _, dir := range dirs {
+		if treeEntryHash(newTree, dir) != treeEntryHash(oldTree, dir) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// returns the hash of the directory or submodule at dir in tree, the zero hash if it doesn't exist
+func treeEntryHash(tree *object.Tree, dir string) plumbing.Hash {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return tree.Hash
+	}
+	entry, err := tree.FindEntry(dir)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return entry.Hash
+}
+
+// whether commit is an ancestor of other, an error is returned if the history of other is incomplete
+func commitIsAncestor(repo *git.Repository, commit plumbing.Hash, other plumbing.Hash) (bool, error) {
+	otherCommit, err := repo.CommitObject(other)
+	if err != nil {
+		return false, err
+	}
+	target, err := repo.CommitObject(commit)
+	if err != nil {
+		return false, err
+	}
+	return target.IsAncestor(otherCommit)
+}
+
+// whether the repository contains the commit with the full SHA sha
+func hasCommit(repo *git.Repository, sha string) bool {
+	_, err := repo.CommitObject(plumbing.NewHash(sha))
+	return err == nil
+}
+
+// creates a repository in dir that reads objects from the cached repository through git alternates
+// instead of storing its own copy, similar to `git worktree add`
+func initWorktree(dir string, cached *git.Repository) (*git.Repository, error) {
+	cachedStorage, ok := cached.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil, errors.New("cached repository is not stored on disk")
+	}
+
+	wtFS := osfs.New(dir, osfs.WithBoundOS())
+	dotGitFS, err := wtFS.Chroot(git.GitDirName)
+	if err != nil {
+		return nil, err
+	}
+	// alternates are absolute paths which the default chroot of the worktree would reject
+	storage := filesystem.NewStorageWithOptions(dotGitFS, cache.NewObjectLRUDefault(), filesystem.Options{
+		AlternatesFS: osfs.New("/", osfs.WithBoundOS()),
+	})
+	repo, err := git.Init(storage, wtFS)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.AddAlternate(cachedStorage.Filesystem().Root())
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// fetches the history of every branch and tag, branches and tags deleted on the remote are removed from a
+// cache kept across runs
+func fullFetch(ctx context.Context, repo *git.Repository, remote *git.Remote, auth transport.AuthMethod) error {
+	return fetchHistory(ctx, repo, remote, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{allBranchesRefSpec, allTagsRefSpec},
+		Auth:     auth,
+		Tags:     git.NoTags,
+		Prune:    true,
+	})
+}
+
+// fetches the full history of a single branch
+func fetchBranchHistory(ctx context.Context, repo *git.Repository, remote *git.Remote, branch string, auth transport.AuthMethod) error {
+	refSpec := fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(branch), plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch))
+	return fetchHistory(ctx, repo, remote, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec(refSpec)},
+		Auth:     auth,
+		Tags:     git.NoTags,
+	})
+}
+
+// fetches the refs of opts including their full history
+func fetchHistory(ctx context.Context, repo *git.Repository, remote *git.Remote, opts *git.FetchOptions) error {
+	// the history behind previously fetched shallow commits is only sent when explicitly deepened,
+	// this is what `git fetch --unshallow` does
+	shallow, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	if len(shallow) > 0 {
+		opts.Depth = math.MaxInt32
+	}
+
+	err = remote.FetchContext(ctx, opts)
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	return nil
+}
+
+// fetches the commit ref points to with depth 1. A full SHA is fetched directly, which the server has to
+// allow, branches and tags are looked up on the remote first and both are fetched if ref names both, so
+// that an ambiguous ref is still detected by resolveRef. The local branch and tag of ref are removed if the
+// remote doesn't have them anymore, a cache kept across runs would otherwise still resolve them
+func shallowFetch(ctx context.Context, repo *git.Repository, remote *git.Remote, ref string, auth transport.AuthMethod) error {
+	var refSpecs []config.RefSpec
+	if commitSHARegexp.MatchString(ref) {
+		refSpecs = append(refSpecs, config.RefSpec(ref+":FETCH_HEAD"))
+	} else {
+		remoteRefs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+		if err != nil {
+			return err
+		}
+		branch, tag := refNames(ref)
+		stale := map[plumbing.ReferenceName]bool{}
+		if branch != "" {
+			stale[plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch)] = true
+		}
+		if tag != "" {
+			stale[plumbing.NewTagReferenceName(tag)] = true
+		}
+		for _, remoteRef := range remoteRefs {
+			switch remoteRef.Name() {
+			case plumbing.NewBranchReferenceName(branch):
+				local := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch)
+				refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("+%s:%s", remoteRef.Name(), local)))
+				delete(stale, local)
+			case plumbing.NewTagReferenceName(tag):
+				refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("+%s:%s", remoteRef.Name(), remoteRef.Name())))
+				delete(stale, remoteRef.Name())
+			}
+		}
+		for name := range stale {
+			err = repo.Storer.RemoveReference(name)
+			if err != nil {
+				return err
+			}
+		}
+		if len(refSpecs) == 0 {
+			return refNotFoundError{ref: ref}
+		}
+	}
+
+	err := remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: refSpecs,
+		Depth:    1,
+		Auth:     auth,
+		Tags:     git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	return nil
+}
+
+// local module sources in .tf and .tf.json files, see
+// https://developer.hashicorp.com/terraform/language/modules/sources#local-paths
+var localModuleSourceRegexp = regexp.MustCompile(`\bsource"?\s*[=:]\s*"(\.\.?/[^"]*)"`)
+
+// paths leaving a directory, e.g. "${path.module}/../policy.json" or "../lambda", outside of local module sources
+var parentPathRegexp = regexp.MustCompile(`(?:^|[\s"'=/])\.\.(?:[/"']|$)`)
+
+// returns the directories to check out for running terraform in projectPath: projectPath itself and the
+// local modules it uses, recursively. Nil is returned if the whole repository is needed, which is also the
+// case when any of their .tf files contains another path with `..`, e.g. for file() or archive_file, as
+// the files these paths refer to can't be determined
+func sparseCheckoutDirs(repo *git.Repository, sha plumbing.Hash, projectPath string) ([]string, error) {
+	commit, err := repo.CommitObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	seen := map[string]bool{}
+	queue := []string{path.Clean(projectPath)}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		if dir == "." {
+			return nil, nil
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		dirTree, err := tree.Tree(dir)
+		if err != nil {
+			// modules vendored as submodules are checked out with the whole submodule
+			if sub, ok := submoduleContaining(tree, dir); ok {
+				if !seen[sub] {
+					seen[sub] = true
+					dirs = append(dirs, sub+"/")
+				}
+				continue
+			}
+			return nil, fmt.Errorf("directory '%s' not found in commit %s: %w", dir, sha, err)
+		}
+		// directories are matched by prefix, the trailing slash prevents matching foo-bar for foo
+		dirs = append(dirs, dir+"/")
+		for _, entry := range dirTree.Entries {
+			if !entry.Mode.IsFile() || !(strings.HasSuffix(entry.Name, ".tf") || strings.HasSuffix(entry.Name, ".tf.json")) {
+				continue
+			}
+			file, err := dirTree.TreeEntryFile(&entry)
+			if err != nil {
+				return nil, err
+			}
+			contents, err := file.Contents()
+			if err != nil {
+				return nil, err
+			}
+			if parentPathRegexp.MatchString(localModuleSourceRegexp.ReplaceAllString(contents, "")) {
+				return nil, nil
+			}
+			for _, match := range localModuleSourceRegexp.FindAllStringSubmatch(contents, -1) {
+				module := path.Join(dir, match[1])
+				if module == ".." || strings.HasPrefix(module, "../") {
+					return nil, fmt.Errorf("module source '%s' in '%s/%s' is outside of the repository", match[1], dir, entry.Name)
+				}
+				queue = append(queue, module)
+			}
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,303 @@
+package pkg
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// creates a repository on disk with the given files committed and tagged as v1, returns its path and the commit hash
+func testOriginRepo(t *testing.T, files map[string]string) (string, plumbing.Hash) {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	hash := testCommit(t, dir, files)
+	_, err = repo.CreateTag("v1", hash, nil)
+	assert.NoError(t, err)
+	return dir, hash
+}
+
+// commits the given files to the repository at dir
+func testCommit(t *testing.T, dir string, files map[string]string) plumbing.Hash {
+	t.Helper()
+	repo, err := git.PlainOpen(dir)
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+
+	for name, contents := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644))
+		_, err = wt.Add(name)
+		assert.NoError(t, err)
+	}
+	hash, err := wt.Commit("commit", &git.CommitOptions{
+		Author:            &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+		AllowEmptyCommits: true,
+	})
+	assert.NoError(t, err)
+	return hash
+}
+
+// opens a clone cache in a temporary directory that is removed when the test finishes
+func testCloneCache(t *testing.T) *cloneCache {
+	t.Helper()
+	c, err := openCloneCache("")
+	assert.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.close()) })
+	return c
+}
+
+func TestCloneRepo(t *testing.T) {
+	origin, hash := testOriginRepo(t, map[string]string{
+		"README.md":               "readme",
+		"infra/main.tf":           "module \"vpc\" {\n  source = \"../modules/vpc\"\n}\n",
+		"infra-old/main.tf":       "",
+		"modules/vpc/main.tf":     "module \"subnet\" {\n  source = \"./subnet\"\n}\nmodule \"remote\" {\n  source = \"terraform-aws-modules/vpc/aws\"\n}\n",
+		"modules/vpc/subnet/x.tf": "",
+		"modules/other/main.tf":   "",
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	testCases := []struct {
+		name      string
+		repo      Repo
+		present   []string
+		notInTree []string
+		shallow   bool
+	}{
+		{
+			// the file transport doesn't allow fetching a SHA so this falls back to a full clone
+			name:    "full sha",
+			repo:    Repo{Name: "a", URL: origin, Ref: hash.String(), Path: "infra"},
+			present: []string{"README.md", "infra/main.tf", "modules/other/main.tf"},
+		},
+		{
+			name:    "short sha",
+			repo:    Repo{Name: "a", URL: origin, Ref: hash.String()[:8]},
+			present: []string{"README.md"},
+		},
+		{
+			name:    "branch",
+			repo:    Repo{Name: "a", URL: origin, Ref: "master"},
+			present: []string{"README.md"},
+			shallow: true,
+		},
+		{
+			name:    "tag",
+			repo:    Repo{Name: "a", URL: origin, Ref: "v1"},
+			present: []string{"README.md"},
+			shallow: true,
+		},
+		{
+			name:      "sparse checkout includes local modules",
+			repo:      Repo{Name: "a", URL: origin, Ref: "master", Path: "infra", SparseCheckout: true},
+			present:   []string{"infra/main.tf", "modules/vpc/main.tf", "modules/vpc/subnet/x.tf"},
+			notInTree: []string{"README.md", "infra-old/main.tf", "modules/other/main.tf"},
+			shallow:   true,
+		},
+		{
+			name:    "sparse checkout of the repository root",
+			repo:    Repo{Name: "a", URL: origin, Ref: "master", SparseCheckout: true},
+			present: []string{"README.md", "modules/other/main.tf"},
+			shallow: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testCloneCache(t)
+			dir := filepath.Join(t.TempDir(), "a")
+			commit, err := c.cloneRepo(t.Context(), tc.repo, dir, nil, logger)
+			assert.NoError(t, err)
+			assert.Equal(t, hash, commit.Hash)
+			for _, name := range tc.present {
+				assert.FileExists(t, filepath.Join(dir, name))
+			}
+			for _, name := range tc.notInTree {
+				assert.NoFileExists(t, filepath.Join(dir, name))
+			}
+
+			cached, err := c.open(origin)
+			assert.NoError(t, err)
+			shallow, err := cached.repo.Storer.Shallow()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.shallow, len(shallow) > 0)
+		})
+	}
+
+	t.Run("unknown ref", func(t *testing.T) {
+		repo := Repo{Name: "a", URL: origin, Ref: "feature"}
+		_, err := testCloneCache(t).cloneRepo(t.Context(), repo, filepath.Join(t.TempDir(), "a"), nil, logger)
+		assert.EqualError(t, err, "ref 'feature' does not match any branch, tag or commit")
+	})
+}
+
+func TestCloneCache(t *testing.T) {
+	origin, first := testOriginRepo(t, map[string]string{"main.tf": ""})
+	second := testCommit(t, origin, map[string]string{"second.tf": ""})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cacheDir := t.TempDir()
+	workdir := t.TempDir()
+
+	c, err := openCloneCache(cacheDir)
+	assert.NoError(t, err)
+	clone := func(c *cloneCache, name string, ref string) (string, error) {
+		commit, err := c.cloneRepo(t.Context(), Repo{Name: name, URL: origin, Ref: ref}, filepath.Join(workdir, name), nil, logger)
+		if err != nil {
+			return "", err
+		}
+		return commit.Hash.String(), nil
+	}
+
+	sha, err := clone(c, "a", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, second.String(), sha)
+	// the worktree reads the objects of the cached repository
+	assert.FileExists(t, filepath.Join(workdir, "a", ".git", "objects", "info", "alternates"))
+	assert.FileExists(t, filepath.Join(workdir, "a", "second.tf"))
+
+	// the history behind the shallow commit is fetched for resolving an abbreviated SHA
+	sha, err = clone(c, "b", first.String()[:7])
+	assert.NoError(t, err)
+	assert.Equal(t, first.String(), sha)
+	assert.NoFileExists(t, filepath.Join(workdir, "b", "second.tf"))
+
+	// a ref is only fetched once per run
+	third := testCommit(t, origin, nil)
+	sha, err = clone(c, "c", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, second.String(), sha)
+	assert.NoError(t, c.close())
+	assert.DirExists(t, cacheDir)
+
+	// the next run fetches the ref again
+	c, err = openCloneCache(cacheDir)
+	assert.NoError(t, err)
+	sha, err = clone(c, "d", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, third.String(), sha)
+
+	// cached commits are used without contacting the server
+	assert.NoError(t, os.RemoveAll(origin))
+	sha, err = clone(c, "e", first.String())
+	assert.NoError(t, err)
+	assert.Equal(t, first.String(), sha)
+}
+
+func TestCloneCacheDeletedRefs(t *testing.T) {
+	origin, first := testOriginRepo(t, map[string]string{"main.tf": ""})
+	originRepo, err := git.PlainOpen(origin)
+	assert.NoError(t, err)
+	assert.NoError(t, originRepo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("feature"), first)))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cacheDir := t.TempDir()
+	workdir := t.TempDir()
+
+	clone := func(name string, ref string) error {
+		c, err := openCloneCache(cacheDir)
+		assert.NoError(t, err)
+		defer c.close()
+		_, err = c.cloneRepo(t.Context(), Repo{Name: name, URL: origin, Ref: ref}, filepath.Join(workdir, name), nil, logger)
+		return err
+	}
+	assert.NoError(t, clone("branch", "feature"))
+	assert.NoError(t, clone("tag", "v1"))
+
+	// later runs don't resolve the refs left in the cache once they're deleted on the remote
+	assert.NoError(t, originRepo.Storer.RemoveReference(plumbing.NewBranchReferenceName("feature")))
+	assert.NoError(t, originRepo.DeleteTag("v1"))
+	assert.EqualError(t, clone("branch-deleted", "feature"), "ref 'feature' does not match any branch, tag or commit")
+	assert.EqualError(t, clone("tag-deleted", "v1"), "ref 'v1' does not match any branch, tag or commit")
+
+	// fetching the full history prunes them as well
+	assert.NoError(t, originRepo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("feature"), first)))
+	assert.NoError(t, clone("branch-again", "feature"))
+	assert.NoError(t, originRepo.Storer.RemoveReference(plumbing.NewBranchReferenceName("feature")))
+	assert.NoError(t, clone("short-sha", first.String()[:7]))
+	c, err := openCloneCache(cacheDir)
+	assert.NoError(t, err)
+	defer c.close()
+	cached, err := c.open(origin)
+	assert.NoError(t, err)
+	_, err = cached.repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, "feature"), false)
+	assert.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+}
+
+func TestCheckReachable(t *testing.T) {
+	origin, first := testOriginRepo(t, map[string]string{"main.tf": ""})
+	repo, err := git.PlainOpen(origin)
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	assert.NoError(t, wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature"), Create: true}))
+	unmerged := testCommit(t, origin, map[string]string{"feature.tf": ""})
+	assert.NoError(t, wt.Checkout(&git.CheckoutOptions{Branch: plumbing.Master}))
+	testCommit(t, origin, map[string]string{"second.tf": ""})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c := testCloneCache(t)
+	workdir := t.TempDir()
+	check := func(name string, ref string, branch string) error {
+		r := Repo{Name: name, URL: origin, Ref: ref}
+		commit, err := c.cloneRepo(t.Context(), r, filepath.Join(workdir, name), nil, logger)
+		assert.NoError(t, err)
+		return c.checkReachable(t.Context(), r, commit, branch, nil)
+	}
+
+	// the tag is fetched without history, which is fetched for the protected branch
+	assert.NoError(t, check("tag", "v1", "master"))
+	assert.NoError(t, check("master", "master", "master"))
+	assert.EqualError(t, check("feature", "feature", "master"), "commit "+unmerged.String()+" is not reachable from protected branch 'master'")
+	assert.EqualError(t, check("missing", first.String(), "missing"), "protected branch 'missing' does not exist")
+}
+
+func TestSparseCheckoutDirs(t *testing.T) {
+	origin, hash := testOriginRepo(t, map[string]string{
+		"infra/main.tf":             "module \"a\" {\n  source = \"../../outside\"\n}\n",
+		"json/main.tf.json":         "{\"module\": {\"a\": {\"source\": \"../infra\"}}}",
+		"cycle/a/main.tf":           "module \"b\" {\n  source = \"../b\"\n}\n",
+		"cycle/b/main.tf":           "module \"a\" {\n  source = \"../a/\"\n}\n",
+		"root-module/main.tf":       "module \"root\" {\n  source = \"../\"\n}\n",
+		"file/main.tf":              "module \"a\" {\n  source = \"../cycle/a\"\n}\nlocals {\n  policy = file(\"${path.module}/../policy.json\")\n}\n",
+		"archive/main.tf":           "module \"a\" {\n  source = \"./modules/a\"\n}\n",
+		"archive/modules/a/main.tf": "data \"archive_file\" \"lambda\" {\n  source_dir = \"../../../lambda\"\n}\n",
+		"dots/main.tf":              "locals {\n  args = [for x in var.list : x]\n  all  = concat(local.args...)\n}\n",
+	})
+	repo, err := git.PlainOpen(origin)
+	assert.NoError(t, err)
+
+	dirs, err := sparseCheckoutDirs(repo, hash, "cycle/a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cycle/a/", "cycle/b/"}, dirs)
+
+	dirs, err = sparseCheckoutDirs(repo, hash, "root-module")
+	assert.NoError(t, err)
+	assert.Nil(t, dirs)
+
+	// files outside of the modules may be read, so everything is checked out
+	for _, projectPath := range []string{"file", "archive"} {
+		dirs, err = sparseCheckoutDirs(repo, hash, projectPath)
+		assert.NoError(t, err)
+		assert.Nil(t, dirs, projectPath)
+	}
+
+	dirs, err = sparseCheckoutDirs(repo, hash, "dots")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dots/"}, dirs)
+
+	_, err = sparseCheckoutDirs(repo, hash, "json")
+	assert.EqualError(t, err, "module source '../../outside' in 'infra/main.tf' is outside of the repository")
+
+	_, err = sparseCheckoutDirs(repo, hash, "missing")
+	assert.ErrorContains(t, err, "directory 'missing' not found in commit")
+}
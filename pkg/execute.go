@@ -2,41 +2,88 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	_ "embed"
 
+	"github.com/app-sre/terraform-repo-executor/pkg/gitlab"
 	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
-	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	vault "github.com/hashicorp/vault/api"
 )
 
 // Input holds YAML/JSON loaded from CONFIG_FILE and is passed from Qontract Reconcile
 type Input struct {
-	DryRun bool   `yaml:"dry_run" json:"dry_run"`
-	Repos  []Repo `yaml:"repos" json:"repos"`
+	DryRun       bool         `yaml:"dry_run" json:"dry_run"`
+	PublishPlans string       `yaml:"publish_plans,omitempty" json:"publish_plans,omitempty"`
+	MergeRequest MergeRequest `yaml:"merge_request,omitempty" json:"merge_request,omitempty"`
+	Repos        []Repo       `yaml:"repos" json:"repos" jsonschema:"required"`
 }
 
+// MergeRequest identifies the GitLab merge request a run was triggered for, e.g. the App Interface MR
+// changing the repos. The project is its path with namespace or its numeric ID
+type MergeRequest struct {
+	Project string `yaml:"project" json:"project"`
+	IID     int    `yaml:"iid" json:"iid"`
+}
+
+// destinations of the plans of a dry run selected with `publish_plans`, plans aren't published by default
+const (
+	// `plans/<name>.md` in the state sink
+	PublishPlansStateSink = "state_sink"
+	// a note on the merge request of the config
+	PublishPlansMergeRequest = "merge_request"
+)
+
 // Repo represents an individual Terraform Repo
 type Repo struct {
-	Name        string                `yaml:"name" json:"name"`
-	URL         string                `yaml:"repository" json:"repository"`
-	Path        string                `yaml:"project_path" json:"project_path"`
-	Ref         string                `yaml:"ref" json:"ref"`
-	Delete      bool                  `yaml:"delete" json:"delete"`
-	AWSCreds    vaultutil.VaultSecret `yaml:"aws_creds" json:"aws_creds"`
-	Bucket      string                `yaml:"bucket,omitempty" json:"bucket,omitempty"`
-	Region      string                `yaml:"region,omitempty" json:"region,omitempty"`
-	BucketPath  string                `yaml:"bucket_path,omitempty" json:"bucket_path,omitempty"`
-	RequireFips bool                  `yaml:"require_fips" json:"require_fips"`
-	TfVersion   string                `yaml:"tf_version" json:"tf_version"`
-	TfVariables TfVariables           `yaml:"variables,omitempty" json:"variables,omitempty"`
+	Name             string                `yaml:"name" json:"name" jsonschema:"required"`
+	URL              string                `yaml:"repository" json:"repository" jsonschema:"required"`
+	Path             string                `yaml:"project_path" json:"project_path"`
+	Ref              string                `yaml:"ref" json:"ref" jsonschema:"required"`
+	Delete           bool                  `yaml:"delete" json:"delete"`
+	AWSCreds         vaultutil.VaultSecret `yaml:"aws_creds" json:"aws_creds" jsonschema:"required"`
+	Bucket           string                `yaml:"bucket,omitempty" json:"bucket,omitempty"`
+	Region           string                `yaml:"region,omitempty" json:"region,omitempty"`
+	BucketPath       string                `yaml:"bucket_path,omitempty" json:"bucket_path,omitempty"`
+	RequireFips      bool                  `yaml:"require_fips" json:"require_fips"`
+	TfVersion        string                `yaml:"tf_version" json:"tf_version" jsonschema:"required"`
+	TfVariables      TfVariables           `yaml:"variables,omitempty" json:"variables,omitempty"`
+	DependsOn        []string              `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	Timeout          string                `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	SSHKey           vaultutil.VaultSecret `yaml:"ssh_key,omitempty" json:"ssh_key,omitempty"`
+	SparseCheckout   bool                  `yaml:"sparse_checkout,omitempty" json:"sparse_checkout,omitempty"`
+	RequireSignedRef bool                  `yaml:"require_signed_ref,omitempty" json:"require_signed_ref,omitempty"`
+	ProtectedBranch  string                `yaml:"protected_branch,omitempty" json:"protected_branch,omitempty"`
+	AllowRollback    bool                  `yaml:"allow_rollback,omitempty" json:"allow_rollback,omitempty"`
+	Force            bool                  `yaml:"force,omitempty" json:"force,omitempty"`
+}
+
+// returns how long the repository may take to be processed, falling back to defaultTimeout
+// when no timeout is set for the repository
+func (r Repo) timeout(defaultTimeout time.Duration) (time.Duration, error) {
+	if r.Timeout == "" {
+		return defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(r.Timeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout '%s', expected a positive duration such as '45m'", r.Timeout)
+	}
+	return timeout, nil
 }
 
 // TfVariables are references to Vault paths used for reading/writing inputs and outputs
@@ -51,12 +98,54 @@ type Executor struct {
 	vaultAddr      string
 	vaultRoleID    string
 	vaultSecretID  string
-	gitlabLogRepo  string
 	gitlabUsername string
 	gitlabToken    string
-	gitEmail       string
+	sshKey         vaultutil.VaultSecret
+	gitCredentials []GitCredential
 	mountVersions  map[string]string
 	tfParallelism  int
+	logger         *slog.Logger
+	metrics        *metrics
+
+	// terraform init is run by one repo at a time when the provider plugin cache is shared, terraform doesn't
+	// guarantee that concurrent inits can use the same cache
+	pluginCacheDir string
+	initMu         sync.Mutex
+
+	// git credentials read from vault, keyed by GitCredential.Match
+	credMu    sync.Mutex
+	credCache map[string]*http.BasicAuth
+
+	// bare repositories that repos are checked out from
+	clones *cloneCache
+
+	// the plans of a dry run are published to the state sink or as notes on mergeRequest
+	publishPlans string
+	mergeRequest MergeRequest
+	gitlab       gitlab.Client
+
+	// the outcome of every repo is reported to GitLab as commit status of the repo and as note on mergeRequest
+	gitlabReport bool
+	gitlabHost   string
+
+	// where the state of applied repos is written to, once all repos have been processed
+	sink         stateSink
+	stateMu      sync.Mutex
+	pendingState []stateUpdate
+	// plans published to the state sink, written separately so that they can't fail the run
+	pendingPlans []stateUpdate
+
+	// commits of repos are only applied when they're part of the history of this branch
+	protectedBranch string
+
+	// commits of repos are only planned and applied when signed with one of the keys of signingKeysSecret
+	requireSignedRef  bool
+	signingKeysSecret vaultutil.VaultSecret
+	keysMu            sync.Mutex
+	keys              *signingKeys
+
+	// repos are processed even if nothing changed since their last apply
+	force bool
 }
 
 // StateVars are used to render the raw statefile in markdown
@@ -70,74 +159,296 @@ type StateVars struct {
 //go:embed templates/show.tmpl
 var tmplData string
 
+// FilterRepos returns a copy of cfg only containing the repos with the supplied names, an empty list of
+// names selects all repos. Dependencies on repos that are not selected are dropped as those repos are not run
+func FilterRepos(cfg *Input, names []string) (*Input, error) {
+	if len(names) == 0 {
+		return cfg, nil
+	}
+
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !slices.ContainsFunc(cfg.Repos, func(r Repo) bool { return r.Name == name }) {
+			return nil, fmt.Errorf("repository '%s' is not defined in the config", name)
+		}
+		selected[name] = true
+	}
+
+	// everything but the repos applies to the filtered run as well
+	filtered := *cfg
+	filtered.Repos = nil
+	for _, repo := range cfg.Repos {
+		if !selected[repo.Name] {
+			continue
+		}
+		var dependsOn []string
+		for _, dep := range repo.DependsOn {
+			if selected[dep] {
+				dependsOn = append(dependsOn, dep)
+			}
+		}
+		repo.DependsOn = dependsOn
+		filtered.Repos = append(filtered.Repos, repo)
+	}
+	return &filtered, nil
+}
+
+// Options configure a tf repo executor run, they are populated from environment variables and flags by main
+type Options struct {
+	Workdir            string
+	VaultAddr          string
+	VaultRoleID        string
+	VaultSecretID      string
+	GitlabLogRepo      string
+	GitlabUsername     string
+	GitlabToken        string
+	GitEmail           string
+	SSHKeySecret       string
+	GitCredentials     []GitCredential
+	GitCacheDir        string
+	GitlabURL          string
+	GitlabReport       bool
+	StateSink          string
+	StateDir           string
+	StateS3Bucket      string
+	StateS3Prefix      string
+	StateS3Endpoint    string
+	StateS3Region      string
+	RequireSignedRef   bool
+	SigningKeysSecret  string
+	ProtectedBranch    string
+	Force              bool
+	TfParallelism      int
+	TfPluginCacheDir   string
+	MaxConcurrentRepos int
+	RepoTimeout        time.Duration
+	ReportFile         string
+	MetricsTextfile    string
+	PushgatewayURL     string
+}
+
 // Run is responsible for the full lifecycle of creating/updating/deleting a Terraform repo.
-// Including loading config, secrets from vault, creation and cleanup of temp directories and the actual Terraform operations
-func Run(cfgPath,
-	workdir,
-	vaultAddr,
-	roleID,
-	secretID,
-	gitlabLogRepo,
-	gitlabUsername,
-	gitlabToken,
-	gitEmail string, tfParallelism int) error {
-
-	cfg, err := processConfig(cfgPath)
+// Including loading config, secrets from vault, creation and cleanup of temp directories and the actual Terraform operations.
+// Cancelling ctx interrupts any running terraform process and skips all repos that have not been started yet
+func Run(ctx context.Context, logger *slog.Logger, cfgPath string, opts Options) error {
+	cfg, err := LoadConfig(cfgPath)
 	if err != nil {
 		return err
 	}
 
-	vaultClient, err := vaultutil.InitVaultClient(vaultAddr, roleID, secretID)
+	_, err = RunInput(ctx, logger, cfg, opts)
+	return err
+}
+
+// RunInput performs the Terraform operations for every repo in an already loaded config and returns
+// a report of the outcome of each repo. The report is nil if the run failed before any repo was processed
+func RunInput(ctx context.Context, logger *slog.Logger, cfg *Input, opts Options) (*Report, error) {
+	startedAt := time.Now()
+
+	// config problems are reported before anything is cloned or read from vault
+	err := ValidateInput(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	mountVersions, err := vaultutil.GetMountVersions(vaultClient)
+	graph, err := buildDepGraph(cfg.Repos)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve information about mounted secret engines, please ensure that tf-repo AppRole has access to /sys/mounts. Further info: %s", err)
+		return nil, err
 	}
 
-	// vault creds are stored for later usage when generating tfvars for vault provider
-	e := &Executor{
-		workdir:        workdir,
-		vaultAddr:      vaultAddr,
-		vaultRoleID:    roleID,
-		vaultSecretID:  secretID,
-		gitlabLogRepo:  gitlabLogRepo,
-		gitlabUsername: gitlabUsername,
-		gitlabToken:    gitlabToken,
-		gitEmail:       gitEmail,
-		mountVersions:  mountVersions,
-		tfParallelism:  tfParallelism,
-	}
-
-	errCounter := 0
+	timeouts := make([]time.Duration, len(cfg.Repos))
 	for i, repo := range cfg.Repos {
-		log.Printf("Processing repository %s (%d/%d)", repo.Name, i+1, len(cfg.Repos))
+		timeouts[i], err = repo.timeout(opts.RepoTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("repository '%s': %w", repo.Name, err)
+		}
+		// otherwise the repo would only fail once it has been cloned
+		if (opts.RequireSignedRef || repo.RequireSignedRef) && opts.SigningKeysSecret == "" {
+			return nil, fmt.Errorf("repository '%s' requires a signed ref but GIT_SIGNING_KEYS_SECRET is not set", repo.Name)
+		}
+	}
 
-		// there needs to be a clean working directory for each repository
-		err := os.Mkdir(workdir, FolderPerm)
+	// otherwise the plans would only fail to be published once every repo has been planned
+	if cfg.DryRun && cfg.PublishPlans == PublishPlansMergeRequest && (opts.GitlabURL == "" || opts.GitlabToken == "") {
+		return nil, errors.New("publishing plans to a merge request requires GITLAB_URL and GITLAB_TOKEN")
+	}
+	if opts.GitlabReport && (opts.GitlabURL == "" || opts.GitlabToken == "") {
+		return nil, errors.New("GITLAB_REPORT requires GITLAB_URL and GITLAB_TOKEN")
+	}
+
+	e, vaultClient, err := newExecutor(ctx, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	e.sink, err = e.newStateSink(opts, vaultClient)
+	if err != nil {
+		return nil, err
+	}
+	if opts.GitlabURL != "" {
+		e.gitlab, err = gitlab.NewClient(opts.GitlabURL, opts.GitlabToken)
 		if err != nil {
+			return nil, err
+		}
+		e.gitlabReport = opts.GitlabReport
+	}
+	if cfg.DryRun {
+		e.publishPlans = cfg.PublishPlans
+	}
+	e.mergeRequest = cfg.MergeRequest
+
+	// each repository is cloned into its own subdirectory of workdir so that multiple
+	// independent repositories can be processed at the same time
+	err = os.Mkdir(opts.Workdir, FolderPerm)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(opts.Workdir)
+
+	e.clones, err = openCloneCache(opts.GitCacheDir)
+	if err != nil {
+		return nil, err
+	}
+	defer e.clones.close()
+
+	results := make([]*RepoResult, len(cfg.Repos))
+	for i, repo := range cfg.Repos {
+		results[i] = newRepoResult(repo, cfg.DryRun)
+	}
+
+	outcomes := graph.schedule(ctx, opts.MaxConcurrentRepos,
+		func(ctx context.Context, i int) error {
+			repo := cfg.Repos[i]
+			logger := repoLogger(logger, repo)
+			logger.Info("Processing repository", "position", fmt.Sprintf("%d/%d", i+1, len(cfg.Repos)))
+
+			repoCtx, cancel := context.WithTimeout(ctx, timeouts[i])
+			defer cancel()
+
+			err := e.execute(repoCtx, repo, vaultClient, cfg.DryRun, logger, results[i])
+			if err != nil && errors.Is(repoCtx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("timed out after %s: %w", timeouts[i], err)
+			}
+			if err != nil {
+				logger.Error("Error executing terraform operations", "phase", results[i].FailedPhase, "error", err)
+			} else {
+				logger.Info("Successfully processed repository")
+			}
 			return err
+		},
+		func(i int, reason string) {
+			repoLogger(logger, cfg.Repos[i]).Warn("Not processing repository", "reason", reason)
+		},
+	)
+	stateErrs := e.flushState(ctx, logger)
+	e.flushPlans(ctx, logger)
+
+	report := Report{
+		DryRun:     cfg.DryRun,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+	var failed, interrupted, skipped, stateFailed []string
+	for i, outcome := range outcomes {
+		results[i].complete(outcome)
+		if err, ok := stateErrs[cfg.Repos[i].Name]; ok {
+			results[i].StateError = err.Error()
+			stateFailed = append(stateFailed, cfg.Repos[i].Name)
 		}
+		report.Repos = append(report.Repos, *results[i])
+
+		switch outcome.status {
+		case StatusFailed:
+			failed = append(failed, cfg.Repos[i].Name)
+		case StatusInterrupted:
+			interrupted = append(interrupted, cfg.Repos[i].Name)
+		case StatusSkipped:
+			skipped = append(skipped, cfg.Repos[i].Name)
+		}
+	}
+
+	e.reportResults(ctx, cfg.Repos, report, logger)
+
+	if len(interrupted) > 0 {
+		logger.Warn(fmt.Sprintf("Interrupted %d/%d targets", len(interrupted), len(cfg.Repos)), "repos", interrupted)
+	}
+	if len(skipped) > 0 {
+		logger.Warn(fmt.Sprintf("Skipped %d/%d targets", len(skipped), len(cfg.Repos)), "repos", skipped)
+	}
 
-		err = e.execute(repo, vaultClient, cfg.DryRun)
+	if opts.ReportFile != "" {
+		err = writeReport(report, opts.ReportFile)
 		if err != nil {
-			log.Printf("Error executing terraform operations for: %s\n", repo.Name)
-			log.Println(err)
-			errCounter++
+			logger.Error("Unable to write report", "path", opts.ReportFile, "error", err)
 		}
+	}
 
-		err = os.RemoveAll(workdir)
+	e.metrics.observeReport(report)
+	if opts.MetricsTextfile != "" {
+		err = e.metrics.writeTextfile(opts.MetricsTextfile)
 		if err != nil {
-			return err
+			logger.Error("Unable to write metrics textfile", "path", opts.MetricsTextfile, "error", err)
+		}
+	}
+	if opts.PushgatewayURL != "" {
+		err = e.metrics.push(ctx, opts.PushgatewayURL)
+		if err != nil {
+			logger.Error("Unable to push metrics", "url", opts.PushgatewayURL, "error", err)
 		}
 	}
 
-	if errCounter > 0 {
-		return fmt.Errorf("errors encountered within %d/%d targets", errCounter, len(cfg.Repos))
+	unsuccessful := slices.Concat(failed, interrupted, skipped)
+	if ctx.Err() != nil {
+		return &report, fmt.Errorf("run interrupted, %d/%d targets did not complete: %s", len(unsuccessful), len(cfg.Repos), strings.Join(unsuccessful, ", "))
 	}
-	return nil
+	if len(unsuccessful) > 0 {
+		return &report, fmt.Errorf("errors encountered within %d/%d targets: %s", len(unsuccessful), len(cfg.Repos), strings.Join(unsuccessful, ", "))
+	}
+	// the repos were applied but without their state later runs can't detect rollbacks or unchanged repos
+	if len(stateFailed) > 0 {
+		return &report, fmt.Errorf("unable to write the state of %d/%d targets: %s", len(stateFailed), len(cfg.Repos), strings.Join(stateFailed, ", "))
+	}
+	return &report, nil
+}
+
+// authenticates against vault and creates an Executor for the supplied options
+func newExecutor(ctx context.Context, logger *slog.Logger, opts Options) (*Executor, *vault.Client, error) {
+	vaultClient, err := vaultutil.InitVaultClient(ctx, opts.VaultAddr, opts.VaultRoleID, opts.VaultSecretID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mountVersions, err := vaultutil.GetMountVersions(ctx, vaultClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve information about mounted secret engines, please ensure that tf-repo AppRole has access to /sys/mounts. Further info: %s", err)
+	}
+
+	// the host also receives the GitLab token for submodules, RunInput rejects URLs that don't parse
+	var gitlabHost string
+	if u, err := url.Parse(opts.GitlabURL); err == nil {
+		gitlabHost = u.Hostname()
+	}
+
+	// vault creds are stored for later usage when generating tfvars for vault provider
+	return &Executor{
+		workdir:           opts.Workdir,
+		vaultAddr:         opts.VaultAddr,
+		vaultRoleID:       opts.VaultRoleID,
+		vaultSecretID:     opts.VaultSecretID,
+		gitlabUsername:    opts.GitlabUsername,
+		gitlabToken:       opts.GitlabToken,
+		gitlabHost:        gitlabHost,
+		sshKey:            vaultutil.VaultSecret{Path: opts.SSHKeySecret},
+		protectedBranch:   opts.ProtectedBranch,
+		requireSignedRef:  opts.RequireSignedRef,
+		force:             opts.Force,
+		signingKeysSecret: vaultutil.VaultSecret{Path: opts.SigningKeysSecret},
+		gitCredentials:    opts.GitCredentials,
+		mountVersions:     mountVersions,
+		tfParallelism:     opts.TfParallelism,
+		pluginCacheDir:    opts.TfPluginCacheDir,
+		logger:            logger,
+		metrics:           newMetrics(),
+	}, vaultClient, nil
 }
 
 // terraform-exec does not pass through all variables with tf.SetEnv https://github.com/hashicorp/terraform-exec/issues/337
@@ -159,23 +470,149 @@ func combineEnvVariables(creds TfCreds) map[string]string {
 	return ret
 }
 
+// returns the branch the commit of repo has to be reachable from before it's applied, empty if any
+// commit may be applied
+func (e *Executor) protectedBranchOf(repo Repo) string {
+	if repo.ProtectedBranch != "" {
+		return repo.ProtectedBranch
+	}
+	return e.protectedBranch
+}
+
+// whether the commit of repo has to be signed before it's applied
+func (e *Executor) requiresSignedRef(repo Repo) bool {
+	return e.requireSignedRef || repo.RequireSignedRef
+}
+
 // performs all repo-specific operations
-func (e *Executor) execute(repo Repo, vaultClient *vault.Client, dryRun bool) error {
-	err := repo.cloneRepo(e.workdir, e.gitlabUsername, e.gitlabToken)
+func (e *Executor) execute(ctx context.Context, repo Repo, vaultClient *vault.Client, dryRun bool, logger *slog.Logger, result *RepoResult) error {
+	defer e.cleanup(repo, logger)
+
+	var commit *object.Commit
+	var auth transport.AuthMethod
+	err := result.phase(PhaseClone, logger, func(logger *slog.Logger) error {
+		var err error
+		auth, err = e.gitAuth(ctx, repo, vaultClient)
+		if err != nil {
+			return err
+		}
+		commit, err = e.clones.cloneRepo(ctx, repo, e.repoDir(repo), auth, logger)
+		if err != nil {
+			return err
+		}
+		result.SHA = commit.Hash.String()
+		logger.Info("Checked out ref", "sha", result.SHA)
+
+		// unmerged commits can still be planned, e.g. for reviewing a merge request
+		if branch := e.protectedBranchOf(repo); branch != "" && !dryRun {
+			err = e.clones.checkReachable(ctx, repo, commit, branch, auth)
+			if err != nil {
+				return err
+			}
+			logger.Info("Commit is reachable from protected branch", "branch", branch)
+		}
+
+		if !dryRun && !repo.AllowRollback {
+			err = e.checkRollback(ctx, repo, commit, auth)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	// the ref may be a branch or tag, the resolved commit is what is actually planned and applied
+	logger = logger.With("sha", result.SHA)
+	e.reportPending(ctx, repo, result, logger)
+
+	// credentials are only handed to terraform once the commit is known to come from a trusted signer, for plans
+	// as well since terraform runs the providers and external programs of the commit
+	if e.requiresSignedRef(repo) {
+		err = result.phase(PhaseVerify, logger, func(logger *slog.Logger) error {
+			err := e.verifyCommit(ctx, commit, vaultClient)
+			if err != nil {
+				return err
+			}
+			logger.Info("Verified commit signature")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	secret, err := vaultutil.GetVaultTfSecret(vaultClient, repo.AWSCreds, e.mountVersions)
+	// submodule URLs are read from the commit, so they're only fetched with credentials once it's verified
+	err = result.phase(PhaseClone, logger, func(logger *slog.Logger) error {
+		var err error
+		result.Submodules, err = e.clones.checkoutSubmodules(ctx, repo, e.repoDir(repo), commit, e.submoduleAuth(ctx, repo, vaultClient), logger)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	backendCreds, err := extractTfCreds(secret, repo)
+	var backendCreds TfCreds
+	err = result.phase(PhaseVault, logger, func(logger *slog.Logger) error {
+		backendCreds, result.InputsVersion, err = e.generateVaultFiles(ctx, repo, vaultClient, logger)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// destroying is never skipped as the repo is gone from the config afterwards
+	if !repo.Delete && !e.force && !repo.Force {
+		reason, err := e.unchangedReason(ctx, repo, commit, result.InputsVersion, auth)
+		if err != nil {
+			logger.Warn("Unable to compare with the last apply, processing the repository", "error", err)
+		}
+		if reason != "" {
+			logger.Info("Skipping repository", "reason", reason)
+			result.Status = StatusUnchanged
+			result.SkipReason = reason
+			return nil
+		}
+	}
+
+	tfEnvVars := combineEnvVariables(backendCreds)
+
+	output, err := e.processTfPlan(ctx, repo, vaultClient, dryRun, tfEnvVars, logger, result)
 	if err != nil {
 		return err
 	}
 
+	if output != nil && repo.TfVariables.Outputs.Path != "" {
+		err = result.phase(PhaseOutputWrite, logger, func(logger *slog.Logger) error {
+			err := vaultutil.WriteOutputs(ctx, logger, vaultClient, repo.TfVariables.Outputs, output, e.mountVersions)
+			if err != nil {
+				e.metrics.vaultErrors.WithLabelValues(vaultOpWrite).Inc()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reads the AWS credentials and input variables for a repository from vault and writes them
+// to the files terraform loads, returning the credentials for the S3 backend and the version of the inputs
+func (e *Executor) generateVaultFiles(ctx context.Context, repo Repo, vaultClient *vault.Client, logger *slog.Logger) (TfCreds, int, error) {
+	secret, err := vaultutil.GetVaultTfSecret(ctx, vaultClient, repo.AWSCreds, e.mountVersions)
+	if err != nil {
+		e.metrics.vaultErrors.WithLabelValues(vaultOpRead).Inc()
+		return TfCreds{}, 0, err
+	}
+
+	backendCreds, err := extractTfCreds(secret, repo)
+	if err != nil {
+		return TfCreds{}, 0, err
+	}
+
 	if len(repo.BucketPath) > 0 {
 		backendCreds.Key = fmt.Sprintf("%s/%s-tf-repo.tfstate", repo.BucketPath, repo.Name)
 	} else {
@@ -183,126 +620,103 @@ func (e *Executor) execute(repo Repo, vaultClient *vault.Client, dryRun bool) er
 	}
 	err = e.generateBackendFile(backendCreds, repo)
 	if err != nil {
-		return err
+		return TfCreds{}, 0, err
 	}
 
 	err = e.generateCredVarsFile(backendCreds, repo)
 	if err != nil {
-		return err
+		return TfCreds{}, 0, err
 	}
 
+	var inputsVersion int
 	if repo.TfVariables.Inputs.Path != "" {
 		// extract kv pairs from vault for inputs and write them to a file for terraform usage
-		log.Printf("Loading input secrets from Vault at path: %s", repo.TfVariables.Inputs.Path)
 		if repo.TfVariables.Inputs.Version != 0 {
-			log.Printf("Using specific version: %d", repo.TfVariables.Inputs.Version)
+			logger.Info("Loading input secrets from Vault", "path", repo.TfVariables.Inputs.Path, "version", repo.TfVariables.Inputs.Version)
 		} else {
-			log.Printf("Using latest version")
+			logger.Info("Loading input secrets from Vault", "path", repo.TfVariables.Inputs.Path, "version", "latest")
 		}
-		
-		inputSecret, err := vaultutil.GetVaultTfSecret(vaultClient, repo.TfVariables.Inputs, e.mountVersions)
+
+		inputSecret, version, err := vaultutil.GetVaultTfSecretVersion(ctx, vaultClient, repo.TfVariables.Inputs, e.mountVersions)
 		if err != nil {
-			return err
+			e.metrics.vaultErrors.WithLabelValues(vaultOpRead).Inc()
+			return TfCreds{}, 0, err
 		}
 
 		keys := make([]string, 0, len(inputSecret))
 		for k := range inputSecret {
 			keys = append(keys, k)
 		}
-		log.Printf("Loaded input secret keys: %v", keys)
+		logger.Info("Loaded input secret keys", "keys", keys)
+		inputsVersion = version
 
 		err = e.generateInputVarsFile(inputSecret, repo)
 		if err != nil {
-			return err
+			return TfCreds{}, 0, err
 		}
 	}
 
-	tfEnvVars := combineEnvVariables(backendCreds)
-
-	output, err := e.processTfPlan(repo, dryRun, tfEnvVars)
-	if err != nil {
-		return err
-	}
+	return backendCreds, inputsVersion, nil
+}
 
-	if output != nil && repo.TfVariables.Outputs.Path != "" {
-		err = vaultutil.WriteOutputs(vaultClient, repo.TfVariables.Outputs, output, e.mountVersions)
+// removes the cloned repository and plan file once a repository has been processed
+func (e *Executor) cleanup(repo Repo, logger *slog.Logger) {
+	for _, path := range []string{e.repoDir(repo), e.planFile(repo)} {
+		err := os.RemoveAll(path)
 		if err != nil {
-			return err
+			logger.Warn("Unable to clean up", "path", path, "error", err)
 		}
 	}
-
-	return nil
 }
 
-// clones the output repo, writes the raw state to a file, commits and pushes that to GitLab
-func (e *Executor) commitAndPushState(repo Repo, state string) error {
-	gitAuth := &http.BasicAuth{
-		Username: e.gitlabUsername,
-		Password: e.gitlabToken,
-	}
+// directory that the repository is cloned into
+func (e *Executor) repoDir(repo Repo) string {
+	return fmt.Sprintf("%s/%s", e.workdir, repo.Name)
+}
 
-	tmpdir, err := os.MkdirTemp("", "tf-repo-state")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tmpdir)
+// location of the plan file generated for the repository
+func (e *Executor) planFile(repo Repo) string {
+	return fmt.Sprintf("%s/%s-plan", e.workdir, repo.Name)
+}
 
-	gitRepo, err := git.PlainClone(tmpdir, false, &git.CloneOptions{
-		URL:  e.gitlabLogRepo,
-		Auth: gitAuth,
-	})
+// renders the masked state as markdown and the applied state of repo, they're written to the state sink
+// together with the state of all other applied repos at the end of the run
+func (e *Executor) queueState(repo Repo, applied AppliedState, state string) error {
+	var markdown bytes.Buffer
+	tmpl, err := template.New("show").Parse(tmplData)
 	if err != nil {
-		return fmt.Errorf("could not clone repo: '%s'", err)
+		return fmt.Errorf("could not template markdown: '%s'", err)
 	}
-
-	// prepare to template a markdown file
-	stateVars := &StateVars{
+	err = tmpl.Execute(&markdown, StateVars{
 		RepoName: repo.Name,
 		RepoURL:  repo.URL,
-		RepoSHA:  repo.Ref,
+		RepoSHA:  applied.SHA,
 		State:    MaskSensitiveStateValues(state),
-	}
-
-	err = WriteTemplate(*stateVars, tmplData, fmt.Sprintf("%s/%s.md", tmpdir, repo.Name))
+	})
 	if err != nil {
 		return fmt.Errorf("could not template markdown: '%s'", err)
 	}
 
-	wt, err := gitRepo.Worktree()
-	if err != nil {
-		return fmt.Errorf("could not retrieve git worktree: '%s'", err)
-	}
-
-	st, err := wt.Status()
+	// the last apply is read back by checkRollback and unchangedReason in later runs
+	appliedJSON, err := json.MarshalIndent(applied, "", "  ")
 	if err != nil {
-		return fmt.Errorf("could not retrieve worktree status: '%s'", err)
-	}
-
-	_, err = wt.Add(fmt.Sprintf("%s.md", repo.Name))
-	if err != nil {
-		return fmt.Errorf("could not perform git add: '%s'", err)
+		return err
 	}
 
-	if !st.IsClean() {
-		// no need to commit changes if nothing changed
-		_, err = wt.Commit(fmt.Sprintf("%s: %s", repo.Name, time.Now().Format(time.RFC3339)), &git.CommitOptions{
-			Author: &object.Signature{
-				Name:  e.gitlabUsername,
-				Email: e.gitEmail,
-				When:  time.Now(),
-			},
-		})
-		if err != nil {
-			return fmt.Errorf("could not perform git commit: '%s'", err)
-		}
-
-		err = gitRepo.Push(&git.PushOptions{
-			RemoteName: "origin",
-			Auth:       gitAuth,
-		})
-		if err != nil {
-			return fmt.Errorf("could not push git commit to remote: '%s'", err)
-		}
-	}
+	e.queueUpdate(stateUpdate{
+		repo: repo,
+		sha:  applied.SHA,
+		files: map[string][]byte{
+			repo.Name + ".md":   markdown.Bytes(),
+			repo.Name + ".json": append(appliedJSON, '\n'),
+		},
+	})
 	return nil
 }
+
+// adds an update to the changes written to the state sink at the end of the run
+func (e *Executor) queueUpdate(u stateUpdate) {
+	e.stateMu.Lock()
+	defer e.stateMu.Unlock()
+	e.pendingState = append(e.pendingState, u)
+}
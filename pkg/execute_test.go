@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoTimeout(t *testing.T) {
+	t.Run("default timeout is used when repo does not set one", func(t *testing.T) {
+		timeout, err := Repo{Name: repoName}.timeout(time.Hour)
+
+		assert.Nil(t, err)
+		assert.Equal(t, time.Hour, timeout)
+	})
+
+	t.Run("repo timeout overrides default", func(t *testing.T) {
+		timeout, err := Repo{Name: repoName, Timeout: "2h30m"}.timeout(time.Hour)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 150*time.Minute, timeout)
+	})
+
+	t.Run("invalid repo timeout returns error", func(t *testing.T) {
+		for _, invalid := range []string{"forever", "-5m", "0s"} {
+			_, err := Repo{Name: repoName, Timeout: invalid}.timeout(time.Hour)
+
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestFilterRepos(t *testing.T) {
+	cfg := &Input{
+		DryRun:       true,
+		PublishPlans: PublishPlansStateSink,
+		MergeRequest: MergeRequest{Project: "service/app-interface", IID: 42},
+		Repos: []Repo{
+			{Name: "network"},
+			{Name: "cluster", DependsOn: []string{"network"}},
+			{Name: "app", DependsOn: []string{"cluster", "network"}},
+		},
+	}
+
+	t.Run("no names selects all repos", func(t *testing.T) {
+		filtered, err := FilterRepos(cfg, nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, cfg, filtered)
+	})
+
+	t.Run("dependencies on repos that are not selected are dropped", func(t *testing.T) {
+		filtered, err := FilterRepos(cfg, []string{"app", "network"})
+
+		assert.Nil(t, err)
+		assert.True(t, filtered.DryRun)
+		assert.Equal(t, []Repo{
+			{Name: "network"},
+			{Name: "app", DependsOn: []string{"network"}},
+		}, filtered.Repos)
+		// the original config is left untouched
+		assert.Equal(t, []string{"cluster", "network"}, cfg.Repos[2].DependsOn)
+	})
+
+	t.Run("run settings are kept", func(t *testing.T) {
+		filtered, err := FilterRepos(cfg, []string{"network"})
+
+		assert.Nil(t, err)
+		assert.Equal(t, PublishPlansStateSink, filtered.PublishPlans)
+		assert.Equal(t, MergeRequest{Project: "service/app-interface", IID: 42}, filtered.MergeRequest)
+	})
+
+	t.Run("unknown repo returns error", func(t *testing.T) {
+		_, err := FilterRepos(cfg, []string{"database"})
+
+		assert.EqualError(t, err, "repository 'database' is not defined in the config")
+	})
+}
@@ -0,0 +1,309 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	vault "github.com/hashicorp/vault/api"
+	"gopkg.in/yaml.v3"
+)
+
+// GitCredential is the username and token used for HTTPS git URLs of a host or below a URL prefix.
+// The token is read from the `token` key of the referenced vault secret, the username from the
+// `username` key if it's not set in the credential itself
+type GitCredential struct {
+	Match    string                `yaml:"match" json:"match"`
+	Username string                `yaml:"username,omitempty" json:"username,omitempty"`
+	Secret   vaultutil.VaultSecret `yaml:"secret" json:"secret"`
+}
+
+// keys of the vault secret holding a git credential
+const (
+	GitCredentialUsername = "username"
+	GitCredentialToken    = "token"
+)
+
+// LoadGitCredentials reads the list of git credentials from a YAML or JSON file
+func LoadGitCredentials(path string) ([]GitCredential, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []GitCredential
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	err = dec.Decode(&creds)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse git credentials: %w", err)
+	}
+
+	for i, cred := range creds {
+		if cred.Match == "" {
+			return nil, fmt.Errorf("git credential #%d: match is required", i+1)
+		}
+		if strings.Contains(cred.Match, "/") {
+			u, err := neturl.Parse(cred.Match)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("git credential '%s': a URL prefix must include the scheme and host, e.g. https://gitlab.example.com/group/", cred.Match)
+			}
+		}
+		err = vaultutil.ValidatePath(cred.Secret.Path)
+		if err != nil {
+			return nil, fmt.Errorf("git credential '%s': %w", cred.Match, err)
+		}
+	}
+	return creds, nil
+}
+
+// returns the credential for a git URL, a matching URL prefix takes precedence over a matching host
+// and longer prefixes take precedence over shorter ones
+func matchGitCredential(creds []GitCredential, rawURL string, host string) (GitCredential, bool) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return GitCredential{}, false
+	}
+
+	var best GitCredential
+	bestScore := -1
+	for _, cred := range creds {
+		score := -1
+		switch {
+		case strings.Contains(cred.Match, "/"):
+			if prefix, ok := urlPrefixMatch(cred.Match, u); ok {
+				// a prefix of just the host still takes precedence over a matching host
+				score = len(prefix) + 1
+			}
+		case strings.EqualFold(cred.Match, host):
+			score = 0
+		}
+		if score > bestScore {
+			best, bestScore = cred, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// returns the path of the URL prefix match if it covers u. Scheme and host have to be the same and the path
+// may only end within u at a path segment, e.g. https://gitlab.example.com/team doesn't cover
+// https://gitlab.example.com/team-other/repo or https://gitlab.example.com.evil.io/team/repo
+func urlPrefixMatch(match string, u *neturl.URL) (string, bool) {
+	m, err := neturl.Parse(match)
+	if err != nil || m.Host == "" {
+		return "", false
+	}
+	if !strings.EqualFold(m.Scheme, u.Scheme) || !strings.EqualFold(m.Host, u.Host) {
+		return "", false
+	}
+	prefix := strings.TrimSuffix(m.Path, "/")
+	if prefix != "" && u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+		return "", false
+	}
+	return prefix, true
+}
+
+// returns the basic auth credentials for an HTTPS git URL. Without configured git credentials
+// the GitLab username and token are used for every URL, or no credentials if there is no token.
+// Credentials are never sent over plain HTTP
+func (e *Executor) httpAuth(ctx context.Context, url string, vaultClient *vault.Client) (transport.AuthMethod, error) {
+	if len(e.gitCredentials) == 0 && e.gitlabToken == "" {
+		return nil, nil
+	}
+
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git URL '%s': %w", url, err)
+	}
+	switch ep.Protocol {
+	case httpsProtocol:
+	case httpProtocol:
+		return nil, fmt.Errorf("refusing to send git credentials to host '%s' without TLS, use an HTTPS URL", ep.Host)
+	default:
+		// local and git:// URLs don't authenticate
+		return nil, nil
+	}
+
+	if len(e.gitCredentials) == 0 {
+		return &http.BasicAuth{
+			Username: e.gitlabUsername,
+			Password: e.gitlabToken,
+		}, nil
+	}
+
+	cred, ok := matchGitCredential(e.gitCredentials, url, ep.Host)
+	if !ok {
+		return nil, fmt.Errorf("no git credential matches host '%s'", ep.Host)
+	}
+
+	// every credential is only read once per run even when used by concurrently processed repos
+	e.credMu.Lock()
+	defer e.credMu.Unlock()
+	if auth, ok := e.credCache[cred.Match]; ok {
+		return auth, nil
+	}
+
+	secret, err := vaultutil.GetVaultTfSecret(ctx, vaultClient, cred.Secret, e.mountVersions)
+	if err != nil {
+		e.metrics.vaultErrors.WithLabelValues(vaultOpRead).Inc()
+		return nil, fmt.Errorf("unable to read git credential for host '%s': %w", ep.Host, err)
+	}
+	username := cred.Username
+	if username == "" {
+		username, _ = secret[GitCredentialUsername].(string)
+	}
+	token, _ := secret[GitCredentialToken].(string)
+	if username == "" || token == "" {
+		return nil, fmt.Errorf("git credential for host '%s' at '%s' must provide `%s` and `%s`", ep.Host, cred.Secret.Path, GitCredentialUsername, GitCredentialToken)
+	}
+
+	auth := &http.BasicAuth{
+		Username: username,
+		Password: token,
+	}
+	if e.credCache == nil {
+		e.credCache = make(map[string]*http.BasicAuth)
+	}
+	e.credCache[cred.Match] = auth
+	return auth, nil
+}
+
+// keys of the vault secret holding the SSH key used to clone repositories over SSH
+const (
+	SSHPrivateKey = "private_key"
+	SSHKnownHosts = "known_hosts"
+	SSHPassphrase = "passphrase"
+)
+
+const (
+	sshProtocol   = "ssh"
+	httpProtocol  = "http"
+	httpsProtocol = "https"
+	// user for SSH URLs that don't include one, e.g. ssh://gitlab.example.com/group/project.git
+	defaultSSHUser = "git"
+	defaultSSHPort = 22
+)
+
+// returns the credentials for cloning the repository, SSH URLs use the key referenced by the repo
+// or the globally configured key while all other URLs authenticate with a token
+func (e *Executor) gitAuth(ctx context.Context, repo Repo, vaultClient *vault.Client) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(repo.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL '%s': %w", repo.URL, err)
+	}
+
+	if ep.Protocol != sshProtocol {
+		return e.httpAuth(ctx, repo.URL, vaultClient)
+	}
+
+	keySecret := repo.SSHKey
+	if keySecret.Path == "" {
+		keySecret = e.sshKey
+	}
+	if keySecret.Path == "" {
+		return nil, fmt.Errorf("repository URL '%s' uses SSH but neither `ssh_key` nor GIT_SSH_KEY_SECRET is set", repo.URL)
+	}
+
+	secret, err := vaultutil.GetVaultTfSecret(ctx, vaultClient, keySecret, e.mountVersions)
+	if err != nil {
+		e.metrics.vaultErrors.WithLabelValues(vaultOpRead).Inc()
+		return nil, err
+	}
+
+	auth, err := newSSHAuth(ep, secret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use SSH key from '%s': %w", keySecret.Path, err)
+	}
+	return auth, nil
+}
+
+// returns the credentials for the submodules of repo, which use the credential of their own host like
+// any other HTTPS URL and the SSH key of repo for SSH URLs. Submodule URLs come from the checked out
+// commit, so the GitLab token, which isn't bound to a host, is only sent to the host of repo and
+// GITLAB_URL, submodules on other hosts are cloned anonymously
+func (e *Executor) submoduleAuth(ctx context.Context, repo Repo, vaultClient *vault.Client) authFunc {
+	return func(url string) (transport.AuthMethod, error) {
+		if len(e.gitCredentials) == 0 && !e.isTokenHost(url, repo.URL) {
+			return nil, nil
+		}
+		return e.gitAuth(ctx, Repo{URL: url, SSHKey: repo.SSHKey}, vaultClient)
+	}
+}
+
+// whether the GitLab token may be sent to url, which is a submodule of the repository at repoURL. SSH
+// URLs authenticate with a key and only connect to hosts in its known_hosts
+func (e *Executor) isTokenHost(url string, repoURL string) bool {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return false
+	}
+	if ep.Protocol == sshProtocol {
+		return true
+	}
+	repoEp, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ep.Host, repoEp.Host) || (e.gitlabHost != "" && strings.EqualFold(ep.Host, e.gitlabHost))
+}
+
+// creates SSH credentials from a vault secret, only host keys listed in the known_hosts of the
+// secret are accepted so that a spoofed git host can't serve a different revision
+func newSSHAuth(ep *transport.Endpoint, secret vaultutil.VaultKvData) (*gitssh.PublicKeys, error) {
+	privateKey, _ := secret[SSHPrivateKey].(string)
+	knownHosts, _ := secret[SSHKnownHosts].(string)
+	if privateKey == "" || knownHosts == "" {
+		return nil, fmt.Errorf("secret must contain `%s` and `%s`", SSHPrivateKey, SSHKnownHosts)
+	}
+	passphrase, _ := secret[SSHPassphrase].(string)
+
+	user := ep.User
+	if user == "" {
+		user = defaultSSHUser
+	}
+	auth, err := gitssh.NewPublicKeys(user, []byte(privateKey), passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	// known hosts can only be loaded from files, the file is no longer needed once loaded
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(knownHosts)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	db, err := gitssh.NewKnownHostsDb(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	port := ep.Port
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	hostWithPort := net.JoinHostPort(ep.Host, strconv.Itoa(port))
+	if len(db.HostKeys(hostWithPort)) == 0 {
+		return nil, fmt.Errorf("`%s` contains no host key for '%s'", SSHKnownHosts, hostWithPort)
+	}
+
+	auth.HostKeyCallback = db.HostKeyCallback()
+	// only negotiate the algorithms of the known keys, otherwise the server may present a key of another type
+	auth.HostKeyAlgorithms = db.HostKeyAlgorithms(hostWithPort)
+	return auth, nil
+}
@@ -0,0 +1,260 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/lithammer/dedent"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSSHKey(t *testing.T) (string, ssh.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	assert.Nil(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	return string(pem.EncodeToMemory(block)), sshPub
+}
+
+func TestGitAuth(t *testing.T) {
+	t.Run("https repositories use the gitlab token", func(t *testing.T) {
+		e := &Executor{gitlabUsername: "bot", gitlabToken: "token"}
+
+		auth, err := e.gitAuth(t.Context(), repoWithoutExplicitBucketSettings, nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, &http.BasicAuth{Username: "bot", Password: "token"}, auth)
+	})
+
+	t.Run("ssh repositories require a key", func(t *testing.T) {
+		repo := repoWithoutExplicitBucketSettings
+		repo.URL = "git@gitlab.myinstance.com:some-gl-group/project_a.git"
+
+		_, err := (&Executor{}).gitAuth(t.Context(), repo, nil)
+
+		assert.EqualError(t, err, "repository URL 'git@gitlab.myinstance.com:some-gl-group/project_a.git' uses SSH but neither `ssh_key` nor GIT_SSH_KEY_SECRET is set")
+	})
+}
+
+func TestLoadGitCredentials(t *testing.T) {
+	t.Run("credentials are loaded", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "creds.yaml")
+		raw := `
+            - match: gitlab.myinstance.com
+              secret:
+                path: app-sre/creds/gitlab
+            - match: https://github.example.com/app-sre/
+              username: app-sre-bot
+              secret:
+                path: app-sre/creds/github
+                version: 2
+		`
+		assert.Nil(t, os.WriteFile(path, []byte(dedent.Dedent(raw)), 0600))
+
+		creds, err := LoadGitCredentials(path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []GitCredential{
+			{Match: "gitlab.myinstance.com", Secret: vaultutil.VaultSecret{Path: "app-sre/creds/gitlab"}},
+			{Match: "https://github.example.com/app-sre/", Username: "app-sre-bot", Secret: vaultutil.VaultSecret{Path: "app-sre/creds/github", Version: 2}},
+		}, creds)
+	})
+
+	t.Run("credential without vault mount is rejected", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "creds.yaml")
+		assert.Nil(t, os.WriteFile(path, []byte("- match: gitlab.myinstance.com\n  secret:\n    path: gitlab\n"), 0600))
+
+		_, err := LoadGitCredentials(path)
+
+		assert.EqualError(t, err, "git credential 'gitlab.myinstance.com': invalid vault path: gitlab")
+	})
+
+	t.Run("url prefix without scheme is rejected", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "creds.yaml")
+		assert.Nil(t, os.WriteFile(path, []byte("- match: gitlab.myinstance.com/app-sre/\n  secret:\n    path: app-sre/creds/gitlab\n"), 0600))
+
+		_, err := LoadGitCredentials(path)
+
+		assert.EqualError(t, err, "git credential 'gitlab.myinstance.com/app-sre/': a URL prefix must include the scheme and host, e.g. https://gitlab.example.com/group/")
+	})
+}
+
+func TestMatchGitCredential(t *testing.T) {
+	creds := []GitCredential{
+		{Match: "gitlab.myinstance.com"},
+		{Match: "https://gitlab.myinstance.com/"},
+		{Match: "https://gitlab.myinstance.com/some-gl-group/"},
+		{Match: "github.example.com"},
+	}
+
+	for url, expected := range map[string]string{
+		"https://gitlab.myinstance.com/some-gl-group/project_a":  "https://gitlab.myinstance.com/some-gl-group/",
+		"https://gitlab.myinstance.com/other-gl-group/project_b": "https://gitlab.myinstance.com/",
+		"http://gitlab.myinstance.com/other-gl-group/project_b":  "gitlab.myinstance.com",
+		"https://github.example.com/app-sre/repo":                "github.example.com",
+	} {
+		ep, err := transport.NewEndpoint(url)
+		assert.Nil(t, err)
+
+		cred, ok := matchGitCredential(creds, url, ep.Host)
+		assert.True(t, ok)
+		assert.Equal(t, expected, cred.Match, url)
+	}
+
+	_, ok := matchGitCredential(creds, "https://gitlab.other.com/project", "gitlab.other.com")
+	assert.False(t, ok)
+
+	t.Run("url prefixes only match the same host and whole path segments", func(t *testing.T) {
+		creds := []GitCredential{
+			{Match: "https://gitlab.com"},
+			{Match: "https://gitlab.com/team"},
+		}
+
+		for url, expected := range map[string]string{
+			"https://gitlab.com/team/project":       "https://gitlab.com/team",
+			"https://gitlab.com/team":               "https://gitlab.com/team",
+			"https://gitlab.com/team-other/project": "https://gitlab.com",
+			"https://GitLab.com/team/project":       "https://gitlab.com/team",
+		} {
+			cred, ok := matchGitCredential(creds, url, "")
+			assert.True(t, ok, url)
+			assert.Equal(t, expected, cred.Match, url)
+		}
+
+		for _, url := range []string{
+			"https://gitlab.com.evil.io/team/project",
+			"https://gitlab.com:8443/team/project",
+			"https://evil.io/https://gitlab.com/team/project",
+			"http://gitlab.com/team/project",
+		} {
+			_, ok := matchGitCredential(creds, url, "")
+			assert.False(t, ok, url)
+		}
+	})
+}
+
+func TestHTTPAuth(t *testing.T) {
+	t.Run("configured credentials are used", func(t *testing.T) {
+		auth := &http.BasicAuth{Username: "app-sre-bot", Password: "github-token"}
+		e := &Executor{
+			gitlabUsername: "bot",
+			gitlabToken:    "token",
+			gitCredentials: []GitCredential{{Match: "github.example.com"}},
+			credCache:      map[string]*http.BasicAuth{"github.example.com": auth},
+		}
+
+		actual, err := e.httpAuth(t.Context(), "https://github.example.com/app-sre/repo", nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, auth, actual)
+	})
+
+	t.Run("error names host without credential", func(t *testing.T) {
+		e := &Executor{
+			gitlabUsername: "bot",
+			gitlabToken:    "token",
+			gitCredentials: []GitCredential{{Match: "github.example.com"}},
+		}
+
+		_, err := e.httpAuth(t.Context(), repoURL, nil)
+
+		assert.EqualError(t, err, "no git credential matches host 'gitlab.myinstance.com'")
+	})
+
+	t.Run("credentials are not sent over plain http", func(t *testing.T) {
+		e := &Executor{gitlabUsername: "bot", gitlabToken: "token"}
+
+		_, err := e.httpAuth(t.Context(), "http://gitlab.myinstance.com/some-gl-group/project_a", nil)
+
+		assert.EqualError(t, err, "refusing to send git credentials to host 'gitlab.myinstance.com' without TLS, use an HTTPS URL")
+	})
+
+	t.Run("local repositories don't use credentials", func(t *testing.T) {
+		e := &Executor{gitlabUsername: "bot", gitlabToken: "token"}
+
+		auth, err := e.httpAuth(t.Context(), t.TempDir(), nil)
+
+		assert.Nil(t, err)
+		assert.Nil(t, auth)
+	})
+}
+
+func TestSubmoduleAuth(t *testing.T) {
+	e := &Executor{gitlabUsername: "bot", gitlabToken: "token", gitlabHost: "gitlab.example.com"}
+	authFor := e.submoduleAuth(t.Context(), repoWithoutExplicitBucketSettings, nil)
+
+	for url, expected := range map[string]transport.AuthMethod{
+		"https://gitlab.myinstance.com/some-gl-group/shared": &http.BasicAuth{Username: "bot", Password: "token"},
+		"https://GitLab.example.com/app-sre/modules":         &http.BasicAuth{Username: "bot", Password: "token"},
+		"https://gitlab.myinstance.com.evil.io/collect":      nil,
+		"https://github.com/app-sre/modules":                 nil,
+	} {
+		auth, err := authFor(url)
+		assert.Nil(t, err, url)
+		assert.Equal(t, expected, auth, url)
+	}
+
+	_, err := authFor("http://gitlab.myinstance.com/some-gl-group/shared")
+	assert.EqualError(t, err, "refusing to send git credentials to host 'gitlab.myinstance.com' without TLS, use an HTTPS URL")
+}
+
+func TestNewSSHAuth(t *testing.T) {
+	privateKey, _ := newTestSSHKey(t)
+	_, hostKey := newTestSSHKey(t)
+	_, otherHostKey := newTestSSHKey(t)
+	hostAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	secret := vaultutil.VaultKvData{
+		SSHPrivateKey: privateKey,
+		SSHKnownHosts: knownhosts.Line([]string{"gitlab.myinstance.com"}, hostKey) + "\n",
+	}
+
+	t.Run("only the known host key is accepted", func(t *testing.T) {
+		ep, err := transport.NewEndpoint("git@gitlab.myinstance.com:some-gl-group/project_a.git")
+		assert.Nil(t, err)
+
+		auth, err := newSSHAuth(ep, secret)
+		assert.Nil(t, err)
+		assert.Equal(t, "git", auth.User)
+		assert.Equal(t, []string{ssh.KeyAlgoED25519}, auth.HostKeyAlgorithms)
+
+		assert.Nil(t, auth.HostKeyCallback("gitlab.myinstance.com:22", hostAddr, hostKey))
+		assert.Error(t, auth.HostKeyCallback("gitlab.myinstance.com:22", hostAddr, otherHostKey))
+	})
+
+	t.Run("user and port are taken from the URL", func(t *testing.T) {
+		ep, err := transport.NewEndpoint("ssh://deploy@gitlab.myinstance.com:2222/some-gl-group/project_a.git")
+		assert.Nil(t, err)
+
+		_, err = newSSHAuth(ep, secret)
+		assert.EqualError(t, err, "`known_hosts` contains no host key for 'gitlab.myinstance.com:2222'")
+
+		portSecret := vaultutil.VaultKvData{
+			SSHPrivateKey: privateKey,
+			SSHKnownHosts: knownhosts.Line([]string{"[gitlab.myinstance.com]:2222"}, hostKey),
+		}
+		auth, err := newSSHAuth(ep, portSecret)
+		assert.Nil(t, err)
+		assert.Equal(t, "deploy", auth.User)
+	})
+
+	t.Run("secret without known hosts is rejected", func(t *testing.T) {
+		ep, err := transport.NewEndpoint("git@gitlab.myinstance.com:some-gl-group/project_a.git")
+		assert.Nil(t, err)
+
+		_, err = newSSHAuth(ep, vaultutil.VaultKvData{SSHPrivateKey: privateKey})
+		assert.EqualError(t, err, "secret must contain `private_key` and `known_hosts`")
+	})
+}
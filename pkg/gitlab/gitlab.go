@@ -0,0 +1,106 @@
+// Package gitlab is a minimal client for the parts of the GitLab REST API the executor reports to
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// timeout of a single API request
+const requestTimeout = 30 * time.Second
+
+// error responses are truncated to this many bytes
+const maxErrorBody = 1 << 10
+
+// states of a commit status
+const (
+	StatePending  = "pending"
+	StateSuccess  = "success"
+	StateFailed   = "failed"
+	StateCanceled = "canceled"
+)
+
+// GitLab rejects commit status descriptions longer than this
+const maxDescription = 255
+
+// CommitStatus is the state of an external job for a commit, shown next to the pipelines of the commit and
+// its merge requests. Each name has its own status which is replaced when the same name is posted again
+type CommitStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// Client posts to the GitLab REST API, projects are identified by their path with namespace, e.g.
+// `service/app-interface`, or their numeric ID
+type Client interface {
+	// adds a note to the merge request with the given IID of project
+	CreateMergeRequestNote(ctx context.Context, project string, iid int, body string) error
+	// sets the status of the commit sha of project, descriptions that are too long are truncated
+	SetCommitStatus(ctx context.Context, project string, sha string, status CommitStatus) error
+}
+
+type client struct {
+	apiURL string
+	token  string
+	http   *http.Client
+}
+
+// NewClient creates a client for the GitLab instance at baseURL, e.g. https://gitlab.example.com, that
+// authenticates with a personal, project or group access token
+func NewClient(baseURL string, token string) (Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid GitLab URL '%s'", baseURL)
+	}
+	return &client{
+		apiURL: strings.TrimSuffix(baseURL, "/") + "/api/v4",
+		token:  token,
+		http:   &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+func (c *client) CreateMergeRequestNote(ctx context.Context, project string, iid int, body string) error {
+	return c.post(ctx, fmt.Sprintf("/projects/%s/merge_requests/%d/notes", url.PathEscape(project), iid), map[string]string{
+		"body": body,
+	})
+}
+
+func (c *client) SetCommitStatus(ctx context.Context, project string, sha string, status CommitStatus) error {
+	if len(status.Description) > maxDescription {
+		status.Description = strings.ToValidUTF8(status.Description[:maxDescription-3], "") + "..."
+	}
+	return c.post(ctx, fmt.Sprintf("/projects/%s/statuses/%s", url.PathEscape(project), url.PathEscape(sha)), status)
+}
+
+// sends payload as JSON, any status but 2xx is an error
+func (c *client) post(ctx context.Context, path string, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL+path, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("POST %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
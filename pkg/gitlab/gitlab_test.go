@@ -0,0 +1,72 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateMergeRequestNote(t *testing.T) {
+	var gotPath, gotToken string
+	var gotBody map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		gotToken = r.Header.Get("PRIVATE-TOKEN")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&gotBody))
+		if gotBody["body"] == "forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message":"403 Forbidden"}` + "\n"))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL+"/", "token")
+	assert.NoError(t, err)
+
+	err = c.CreateMergeRequestNote(t.Context(), "service/app-interface", 42, "plan")
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/v4/projects/service%2Fapp-interface/merge_requests/42/notes", gotPath)
+	assert.Equal(t, "token", gotToken)
+	assert.Equal(t, map[string]string{"body": "plan"}, gotBody)
+
+	err = c.CreateMergeRequestNote(t.Context(), "service/app-interface", 42, "forbidden")
+	assert.EqualError(t, err, `POST /projects/service%2Fapp-interface/merge_requests/42/notes: 403 Forbidden: {"message":"403 Forbidden"}`)
+}
+
+func TestSetCommitStatus(t *testing.T) {
+	var gotPath string
+	var gotStatus CommitStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&gotStatus))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, "token")
+	assert.NoError(t, err)
+
+	err = c.SetCommitStatus(t.Context(), "group/repo", "d82b3cb292d91ec2eb26fc282d751555088819f3", CommitStatus{
+		State:       StateFailed,
+		Name:        "terraform-repo/foo",
+		Description: strings.Repeat("x", 300),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/v4/projects/group%2Frepo/statuses/d82b3cb292d91ec2eb26fc282d751555088819f3", gotPath)
+	assert.Equal(t, StateFailed, gotStatus.State)
+	assert.Equal(t, "terraform-repo/foo", gotStatus.Name)
+	assert.Equal(t, strings.Repeat("x", 252)+"...", gotStatus.Description)
+}
+
+func TestNewClient(t *testing.T) {
+	for _, baseURL := range []string{"", "gitlab.example.com", "ftp://gitlab.example.com"} {
+		_, err := NewClient(baseURL, "token")
+		assert.EqualError(t, err, "invalid GitLab URL '"+baseURL+"'")
+	}
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/gitlab"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// prefix of the name of the commit statuses, followed by the name of the repo
+const commitStatusPrefix = "terraform-repo/"
+
+// errors in the merge request summary are truncated to this many bytes
+const maxSummaryError = 10_000
+
+//go:embed templates/summary.tmpl
+var summaryTmplData string
+
+// marks the commit of repo as being processed
+func (e *Executor) reportPending(ctx context.Context, repo Repo, result *RepoResult, logger *slog.Logger) {
+	e.setCommitStatus(ctx, repo, result.SHA, gitlab.StatePending, fmt.Sprintf("%s in progress", result.Action), logger)
+}
+
+// sets the final commit status of every repo that was cloned and posts a summary of the run to the merge request
+// of the config. Failures are only logged as they don't affect the infrastructure
+func (e *Executor) reportResults(ctx context.Context, repos []Repo, report Report, logger *slog.Logger) {
+	if !e.gitlabReport {
+		return
+	}
+	// the outcome of an interrupted run is still reported
+	ctx = context.WithoutCancel(ctx)
+
+	for i, result := range report.Repos {
+		if result.SHA == "" {
+			continue
+		}
+		state, description := commitStatusOf(result)
+		e.setCommitStatus(ctx, repos[i], result.SHA, state, description, repoLogger(logger, repos[i]))
+	}
+
+	if e.mergeRequest.IID == 0 {
+		return
+	}
+	summary, err := renderSummary(report)
+	if err == nil {
+		err = e.gitlab.CreateMergeRequestNote(ctx, e.mergeRequest.Project, e.mergeRequest.IID, summary)
+	}
+	if err != nil {
+		logger.Warn("Unable to post summary to merge request", "project", e.mergeRequest.Project, "iid", e.mergeRequest.IID, "error", err)
+	}
+}
+
+// posts a commit status for repos hosted on the GitLab instance at GITLAB_URL
+func (e *Executor) setCommitStatus(ctx context.Context, repo Repo, sha string, state string, description string, logger *slog.Logger) {
+	if !e.gitlabReport {
+		return
+	}
+	project, ok := gitlabProject(repo.URL, e.gitlabHost)
+	if !ok {
+		logger.Debug("Not setting commit status of repository hosted outside of GITLAB_URL")
+		return
+	}
+	err := e.gitlab.SetCommitStatus(ctx, project, sha, gitlab.CommitStatus{
+		State:       state,
+		Name:        commitStatusPrefix + repo.Name,
+		Description: description,
+	})
+	if err != nil {
+		logger.Warn("Unable to set commit status", "state", state, "error", err)
+	}
+}
+
+// returns the path with namespace of the project of a repository URL, if the repository is hosted at host
+func gitlabProject(repoURL string, host string) (string, bool) {
+	ep, err := transport.NewEndpoint(repoURL)
+	if err != nil || !strings.EqualFold(ep.Host, host) {
+		return "", false
+	}
+	project := strings.TrimSuffix(strings.Trim(ep.Path, "/"), ".git")
+	return project, project != ""
+}
+
+// returns the commit status state and description of the outcome of a repo
+func commitStatusOf(result RepoResult) (string, string) {
+	switch result.Status {
+	case StatusSucceeded:
+		if result.Changes == nil {
+			return gitlab.StateSuccess, string(result.Action) + " succeeded"
+		}
+		return gitlab.StateSuccess, fmt.Sprintf("%s: %d to add, %d to change, %d to destroy",
+			result.Action, result.Changes.Add, result.Changes.Change, result.Changes.Destroy)
+	case StatusUnchanged:
+		return gitlab.StateSuccess, result.SkipReason
+	case StatusInterrupted:
+		return gitlab.StateCanceled, "interrupted"
+	default:
+		if result.FailedPhase != "" {
+			return gitlab.StateFailed, fmt.Sprintf("failed in %s: %s", result.FailedPhase, result.Error)
+		}
+		return gitlab.StateFailed, result.Error
+	}
+}
+
+// renders the markdown of the merge request note summarizing a run
+func renderSummary(report Report) (string, error) {
+	tmpl, err := template.New("summary").Parse(summaryTmplData)
+	if err != nil {
+		return "", err
+	}
+	// the report written to REPORT_FILE keeps the full errors
+	report.Repos = slices.Clone(report.Repos)
+	for i, result := range report.Repos {
+		if len(result.Error) > maxSummaryError {
+			report.Repos[i].Error = strings.ToValidUTF8(result.Error[:maxSummaryError], "") + "\n... truncated"
+		}
+	}
+	var summary bytes.Buffer
+	err = tmpl.Execute(&summary, report)
+	if err != nil {
+		return "", err
+	}
+	return summary.String(), nil
+}
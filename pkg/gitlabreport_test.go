@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/gitlab"
+	"github.com/stretchr/testify/assert"
+)
+
+// records the requests to a fake GitLab API by their path
+func testGitlab(t *testing.T) (gitlab.Client, map[string]map[string]any) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := map[string]map[string]any{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var payload map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		requests[r.URL.EscapedPath()] = payload
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := gitlab.NewClient(server.URL, "token")
+	assert.NoError(t, err)
+	return client, requests
+}
+
+func TestReportResults(t *testing.T) {
+	const shaA = "d82b3cb292d91ec2eb26fc282d751555088819f3"
+	const shaB = "47ef09135da2d158ede78dbbe8c59de1775a274c"
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repos := []Repo{
+		{Name: "a", URL: "https://gitlab.example.com/group/a.git"},
+		{Name: "b", URL: "git@gitlab.example.com:group/b.git"},
+		{Name: "c", URL: "https://github.com/org/c"},
+		{Name: "d", URL: "https://gitlab.example.com/group/d"},
+	}
+	report := Report{
+		DryRun: true,
+		Repos: []RepoResult{
+			{Name: "a", SHA: shaA, Action: ActionPlan, Status: StatusSucceeded, Changes: &PlanChanges{Add: 1, Change: 2}},
+			{Name: "b", SHA: shaB, Action: ActionPlan, Status: StatusFailed, FailedPhase: PhasePlan, Error: "invalid provider"},
+			{Name: "c", SHA: shaA, Action: ActionPlan, Status: StatusSucceeded},
+			{Name: "d", Action: ActionPlan, Status: StatusSkipped, SkipReason: "skipped because b failed"},
+		},
+	}
+
+	t.Run("commit statuses and summary", func(t *testing.T) {
+		client, requests := testGitlab(t)
+		e := &Executor{
+			gitlab:       client,
+			gitlabReport: true,
+			gitlabHost:   "gitlab.example.com",
+			mergeRequest: MergeRequest{Project: "service/app-interface", IID: 42},
+		}
+
+		e.reportPending(t.Context(), repos[0], &RepoResult{SHA: shaA, Action: ActionPlan}, logger)
+		assert.Equal(t, map[string]any{"state": "pending", "name": "terraform-repo/a", "description": "plan in progress"},
+			requests["/api/v4/projects/group%2Fa/statuses/"+shaA])
+
+		e.reportResults(t.Context(), repos, report, logger)
+		assert.Len(t, requests, 3)
+		assert.Equal(t, map[string]any{"state": "success", "name": "terraform-repo/a", "description": "plan: 1 to add, 2 to change, 0 to destroy"},
+			requests["/api/v4/projects/group%2Fa/statuses/"+shaA])
+		assert.Equal(t, map[string]any{"state": "failed", "name": "terraform-repo/b", "description": "failed in plan: invalid provider"},
+			requests["/api/v4/projects/group%2Fb/statuses/"+shaB])
+
+		note := requests["/api/v4/projects/service%2Fapp-interface/merge_requests/42/notes"]["body"]
+		assert.Equal(t, "### Terraform Repo plan\n\n"+
+			"| Repo | Commit | Status | Add | Change | Destroy |\n"+
+			"| --- | --- | --- | --- | --- | --- |\n"+
+			"| a | `d82b3cb2` | succeeded | 1 | 2 | 0 |\n"+
+			"| b | `47ef0913` | failed | | | |\n"+
+			"| c | `d82b3cb2` | succeeded | | | |\n"+
+			"| d |  | skipped | | | |\n"+
+			"\n<details><summary>b failed in plan</summary>\n\n```\ninvalid provider\n```\n</details>\n", note)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		client, requests := testGitlab(t)
+		e := &Executor{gitlab: client, gitlabHost: "gitlab.example.com", mergeRequest: MergeRequest{Project: "service/app-interface", IID: 42}}
+
+		e.reportPending(t.Context(), repos[0], &RepoResult{SHA: shaA, Action: ActionPlan}, logger)
+		e.reportResults(t.Context(), repos, report, logger)
+		assert.Empty(t, requests)
+	})
+}
+
+func TestGitlabProject(t *testing.T) {
+	testCases := []struct {
+		url     string
+		project string
+	}{
+		{url: "https://gitlab.example.com/group/sub/repo.git", project: "group/sub/repo"},
+		{url: "https://gitlab.example.com:8443/group/repo", project: "group/repo"},
+		{url: "ssh://git@gitlab.example.com/group/repo.git", project: "group/repo"},
+		{url: "git@gitlab.example.com:group/repo.git", project: "group/repo"},
+		{url: "https://github.com/org/repo"},
+		{url: "https://gitlab.example.com/"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			project, ok := gitlabProject(tc.url, "gitlab.example.com")
+			assert.Equal(t, tc.project != "", ok)
+			assert.Equal(t, tc.project, project)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// full commit SHAs as generated by Qontract Reconcile
+var commitSHARegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// abbreviated commit SHAs need to be at least as long as the ones git abbreviates to
+var shortSHARegexp = regexp.MustCompile(`^[0-9a-f]{4,39}$`)
+
+// prefixes that restrict a ref to only be resolved as branch or tag
+const (
+	branchRefPrefix = "refs/heads/"
+	tagRefPrefix    = "refs/tags/"
+)
+
+// refNotFoundError is returned for a ref that matches no branch, tag or commit
+type refNotFoundError struct {
+	ref string
+}
+
+func (e refNotFoundError) Error() string {
+	return fmt.Sprintf("ref '%s' does not match any branch, tag or commit", e.ref)
+}
+
+// validates that ref can be used as branch or tag name, commit SHAs are valid names as well
+func validateRefName(ref string) error {
+	name := plumbing.ReferenceName(ref)
+	if !strings.HasPrefix(ref, "refs/") {
+		name = plumbing.NewBranchReferenceName(ref)
+	}
+	if err := name.Validate(); err != nil {
+		return fmt.Errorf("ref '%s' is not a valid branch, tag or commit SHA", ref)
+	}
+	return nil
+}
+
+// returns the names of the branch and the tag ref may refer to, a ref qualified with refs/heads/ or
+// refs/tags/ only refers to one of them and the other name is empty
+func refNames(ref string) (branch string, tag string) {
+	if branch, ok := strings.CutPrefix(ref, branchRefPrefix); ok {
+		return branch, ""
+	}
+	if tag, ok := strings.CutPrefix(ref, tagRefPrefix); ok {
+		return "", tag
+	}
+	return ref, ref
+}
+
+// ValidateBranchName checks that name can be used as name of a branch, e.g. for the protected branch
+func ValidateBranchName(name string) error {
+	if err := plumbing.NewBranchReferenceName(name).Validate(); err != nil {
+		return fmt.Errorf("'%s' is not a valid branch name", name)
+	}
+	return nil
+}
+
+// resolves ref in a freshly cloned repository to the full SHA of a commit. The ref can be a full or
+// abbreviated commit SHA, a branch or a tag. A ref matching more than one commit, e.g. a branch and a
+// tag with the same name pointing to different commits, is refused rather than guessed
+func resolveRef(repo *git.Repository, ref string) (plumbing.Hash, error) {
+	// a full SHA is unambiguous, git prefers it over branches and tags of the same name as well
+	if commitSHARegexp.MatchString(ref) {
+		commit, err := repo.CommitObject(plumbing.NewHash(ref))
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("commit '%s' not found: %w", ref, err)
+		}
+		return commit.Hash, nil
+	}
+
+	candidates := map[plumbing.Hash][]string{}
+
+	branch, tag := refNames(ref)
+
+	// branches of a clone are only available as remote tracking branches
+	if branch != "" {
+		hash, err := peeledRef(repo, plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if hash != plumbing.ZeroHash {
+			candidates[hash] = append(candidates[hash], "branch "+branch)
+		}
+	}
+	if tag != "" {
+		hash, err := peeledRef(repo, plumbing.NewTagReferenceName(tag))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if hash != plumbing.ZeroHash {
+			candidates[hash] = append(candidates[hash], "tag "+tag)
+		}
+	}
+
+	if shortSHARegexp.MatchString(ref) {
+		commits, err := repo.CommitObjects()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		err = commits.ForEach(func(c *object.Commit) error {
+			if strings.HasPrefix(c.Hash.String(), ref) {
+				candidates[c.Hash] = append(candidates[c.Hash], "commit "+c.Hash.String())
+			}
+			return nil
+		})
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return plumbing.ZeroHash, refNotFoundError{ref: ref}
+	case 1:
+		for hash := range candidates {
+			return hash, nil
+		}
+	}
+
+	var matches []string
+	for hash, names := range candidates {
+		matches = append(matches, fmt.Sprintf("%s (%s)", strings.Join(names, ", "), hash))
+	}
+	slices.Sort(matches)
+	return plumbing.ZeroHash, fmt.Errorf("ref '%s' is ambiguous, it matches %s", ref, strings.Join(matches, "; "))
+}
+
+// returns the commit a branch or tag points to, annotated tags are peeled to their commit.
+// The zero hash is returned if the reference does not exist
+func peeledRef(repo *git.Repository, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := repo.Reference(name, true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tag, err := repo.TagObject(ref.Hash())
+	switch {
+	case err == nil:
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("tag '%s' does not point to a commit: %w", name.Short(), err)
+		}
+		return commit.Hash, nil
+	case errors.Is(err, plumbing.ErrObjectNotFound):
+		// lightweight tags and branches point to the commit directly
+		return ref.Hash(), nil
+	default:
+		return plumbing.ZeroHash, err
+	}
+}
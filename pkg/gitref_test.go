@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// creates an in-memory repository with two commits, returns the repository and the commit hashes
+func testRefRepo(t *testing.T) (*git.Repository, plumbing.Hash, plumbing.Hash) {
+	t.Helper()
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)}
+	commit := func(msg string) plumbing.Hash {
+		hash, err := wt.Commit(msg, &git.CommitOptions{Author: sig, AllowEmptyCommits: true})
+		assert.NoError(t, err)
+		return hash
+	}
+	first := commit("first")
+	second := commit("second")
+
+	// a clone only has remote tracking branches
+	setRef := func(name plumbing.ReferenceName, hash plumbing.Hash) {
+		assert.NoError(t, repo.Storer.SetReference(plumbing.NewHashReference(name, hash)))
+	}
+	setRef(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, "main"), second)
+	setRef(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, "release"), first)
+	setRef(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, "v1"), second)
+	setRef(plumbing.NewTagReferenceName("v0"), first)
+
+	_, err = repo.CreateTag("v1", first, &git.CreateTagOptions{Tagger: sig, Message: "v1"})
+	assert.NoError(t, err)
+	_, err = repo.CreateTag("release", first, &git.CreateTagOptions{Tagger: sig, Message: "release"})
+	assert.NoError(t, err)
+	return repo, first, second
+}
+
+func TestResolveRef(t *testing.T) {
+	repo, first, second := testRefRepo(t)
+
+	testCases := []struct {
+		name string
+		ref  string
+		want plumbing.Hash
+		err  string
+	}{
+		{name: "full sha", ref: first.String(), want: first},
+		{name: "short sha", ref: second.String()[:7], want: second},
+		{name: "branch", ref: "main", want: second},
+		{name: "lightweight tag", ref: "v0", want: first},
+		{name: "annotated tag is peeled", ref: "refs/tags/v1", want: first},
+		{name: "qualified branch", ref: "refs/heads/v1", want: second},
+		{name: "branch and tag on the same commit", ref: "release", want: first},
+		{
+			name: "branch and tag on different commits",
+			ref:  "v1",
+			err:  "ref 'v1' is ambiguous, it matches branch v1 (" + second.String() + "); tag v1 (" + first.String() + ")",
+		},
+		{name: "unknown ref", ref: "feature", err: "ref 'feature' does not match any branch, tag or commit"},
+		{name: "unknown qualified tag", ref: "refs/tags/main", err: "ref 'refs/tags/main' does not match any branch, tag or commit"},
+		{name: "unknown full sha", ref: "0123456789012345678901234567890123456789", err: "commit '0123456789012345678901234567890123456789' not found: object not found"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hash, err := resolveRef(repo, tc.ref)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, hash)
+		})
+	}
+}
+
+func TestValidateRefName(t *testing.T) {
+	for _, ref := range []string{"main", "v1.2.3", "feature/foo", "refs/tags/v1", "d82b3cb"} {
+		assert.NoError(t, validateRefName(ref), ref)
+	}
+	for _, ref := range []string{"foo..bar", "-main", "main.lock", "with space", "refs/heads/"} {
+		assert.EqualError(t, validateRefName(ref), "ref '"+ref+"' is not a valid branch, tag or commit SHA")
+	}
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// repoOutcome records what happened to a single repository during a run
+type repoOutcome struct {
+	status RepoStatus
+	err    error
+	reason string // why the repository was skipped
+}
+
+// depGraph describes the dependencies between repositories declared with `depends_on`
+// repositories are referenced by their index in the config
+type depGraph struct {
+	names      []string
+	deps       [][]int // repositories each repository depends on
+	dependents [][]int // repositories depending on each repository
+}
+
+// builds the dependency graph for the supplied repositories and errors out if
+// a dependency is unknown or the dependencies contain a cycle
+func buildDepGraph(repos []Repo) (*depGraph, error) {
+	g := &depGraph{
+		names:      make([]string, len(repos)),
+		deps:       make([][]int, len(repos)),
+		dependents: make([][]int, len(repos)),
+	}
+
+	indices := make(map[string]int, len(repos))
+	for i, repo := range repos {
+		g.names[i] = repo.Name
+		indices[repo.Name] = i
+	}
+
+	for i, repo := range repos {
+		for _, dep := range repo.DependsOn {
+			j, ok := indices[dep]
+			if !ok {
+				return nil, fmt.Errorf("repository '%s' depends on unknown repository '%s'", repo.Name, dep)
+			}
+			g.deps[i] = append(g.deps[i], j)
+			g.dependents[j] = append(g.dependents[j], i)
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle detected between repositories: %s", strings.Join(cycle, " -> "))
+	}
+
+	return g, nil
+}
+
+// returns the names of the repositories making up a dependency cycle or nil if there is none
+func (g *depGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.names))
+	var path []int
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		path = append(path, i)
+		for _, dep := range g.deps[i] {
+			switch state[dep] {
+			case visiting:
+				// the cycle starts where dep was first entered on the current path
+				var cycle []string
+				for k := len(path) - 1; k >= 0; k-- {
+					cycle = append([]string{g.names[path[k]]}, cycle...)
+					if path[k] == dep {
+						break
+					}
+				}
+				return append(cycle, g.names[dep])
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range g.names {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// schedule calls run for every repository once all of its dependencies have succeeded, using at most
+// workers goroutines at a time. Repositories whose dependencies did not succeed are passed to skip instead,
+// as is every repository that has not been started yet once ctx is cancelled.
+// Independent repositories are started in the order they are defined in the config
+func (g *depGraph) schedule(ctx context.Context, workers int, run func(ctx context.Context, i int) error, skip func(i int, reason string)) []repoOutcome {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type result struct {
+		i   int
+		err error
+	}
+
+	outcomes := make([]repoOutcome, len(g.names))
+	remaining := make([]int, len(g.names))
+	var ready []int
+	for i := range g.names {
+		remaining[i] = len(g.deps[i])
+		if remaining[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	results := make(chan result)
+	running, finished := 0, 0
+
+	complete := func(i int, outcome repoOutcome) {
+		outcomes[i] = outcome
+		finished++
+		for _, dependent := range g.dependents[i] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	for finished < len(g.names) {
+		for running < workers && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+
+			if reason := g.skipReason(ctx, i, outcomes); reason != "" {
+				skip(i, reason)
+				complete(i, repoOutcome{status: StatusSkipped, reason: reason})
+				continue
+			}
+
+			running++
+			go func() {
+				results <- result{i: i, err: run(ctx, i)}
+			}()
+		}
+
+		if running == 0 {
+			// everything left was skipped while dispatching
+			continue
+		}
+
+		r := <-results
+		running--
+		switch {
+		case r.err != nil && ctx.Err() != nil:
+			complete(r.i, repoOutcome{status: StatusInterrupted, err: r.err})
+		case r.err != nil:
+			complete(r.i, repoOutcome{status: StatusFailed, err: r.err})
+		default:
+			complete(r.i, repoOutcome{status: StatusSucceeded})
+		}
+	}
+
+	return outcomes
+}
+
+// explains why a repository cannot be processed based on the run being interrupted or the outcome
+// of its dependencies. An empty string means that the repository can be processed
+func (g *depGraph) skipReason(ctx context.Context, i int, outcomes []repoOutcome) string {
+	if ctx.Err() != nil {
+		return "skipped because the run was interrupted"
+	}
+	for _, dep := range g.deps[i] {
+		switch outcomes[dep].status {
+		case StatusFailed:
+			return fmt.Sprintf("skipped because %s failed", g.names[dep])
+		case StatusSkipped:
+			return fmt.Sprintf("skipped because %s was skipped", g.names[dep])
+		case StatusInterrupted:
+			return fmt.Sprintf("skipped because %s was interrupted", g.names[dep])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func reposWithDeps(deps map[string][]string, names ...string) []Repo {
+	repos := make([]Repo, 0, len(names))
+	for _, name := range names {
+		repos = append(repos, Repo{Name: name, DependsOn: deps[name]})
+	}
+	return repos
+}
+
+func TestBuildDepGraph(t *testing.T) {
+	t.Run("valid dependencies build a graph", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{
+			"rds": {"network"},
+			"app": {"rds", "network"},
+		}, "app", "rds", "network")
+
+		g, err := buildDepGraph(repos)
+
+		assert.Nil(t, err)
+		assert.Equal(t, [][]int{{1, 2}, {2}, nil}, g.deps)
+		assert.Equal(t, [][]int{nil, {0}, {0, 1}}, g.dependents)
+	})
+
+	t.Run("unknown dependency returns error", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{"rds": {"netwrk"}}, "network", "rds")
+
+		_, err := buildDepGraph(repos)
+
+		assert.EqualError(t, err, "repository 'rds' depends on unknown repository 'netwrk'")
+	})
+
+	t.Run("cycle returns error naming the repositories involved", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{
+			"a": {"b"},
+			"b": {"c"},
+			"c": {"a"},
+		}, "standalone", "a", "b", "c")
+
+		_, err := buildDepGraph(repos)
+
+		assert.EqualError(t, err, "dependency cycle detected between repositories: a -> b -> c -> a")
+	})
+
+	t.Run("self dependency is a cycle", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{"a": {"a"}}, "a")
+
+		_, err := buildDepGraph(repos)
+
+		assert.EqualError(t, err, "dependency cycle detected between repositories: a -> a")
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	t.Run("repositories run after their dependencies", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{
+			"app": {"rds"},
+			"rds": {"network"},
+		}, "app", "rds", "network", "dns")
+		g, err := buildDepGraph(repos)
+		assert.Nil(t, err)
+
+		var mu sync.Mutex
+		var order []string
+		outcomes := g.schedule(context.Background(), 1, func(_ context.Context, i int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, repos[i].Name)
+			return nil
+		}, func(int, string) {
+			t.Fatal("no repository should be skipped")
+		})
+
+		assert.Equal(t, []string{"network", "dns", "rds", "app"}, order)
+		for _, outcome := range outcomes {
+			assert.Equal(t, StatusSucceeded, outcome.status)
+		}
+	})
+
+	t.Run("dependents of a failed repository are skipped", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{
+			"app": {"rds"},
+			"rds": {"network"},
+		}, "app", "rds", "network", "dns")
+		g, err := buildDepGraph(repos)
+		assert.Nil(t, err)
+
+		failure := errors.New("provider error")
+		var mu sync.Mutex
+		skipped := map[string]string{}
+		outcomes := g.schedule(context.Background(), 4, func(_ context.Context, i int) error {
+			if repos[i].Name == "network" {
+				return failure
+			}
+			return nil
+		}, func(i int, reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped[repos[i].Name] = reason
+		})
+
+		assert.Equal(t, map[string]string{
+			"rds": "skipped because network failed",
+			"app": "skipped because rds was skipped",
+		}, skipped)
+		assert.Equal(t, []repoOutcome{
+			{status: StatusSkipped, reason: "skipped because rds was skipped"},
+			{status: StatusSkipped, reason: "skipped because network failed"},
+			{status: StatusFailed, err: failure},
+			{status: StatusSucceeded},
+		}, outcomes)
+	})
+
+	t.Run("no more than the requested number of workers run at once", func(t *testing.T) {
+		repos := reposWithDeps(nil, "a", "b", "c", "d", "e", "f")
+		g, err := buildDepGraph(repos)
+		assert.Nil(t, err)
+
+		var mu sync.Mutex
+		active, maxActive := 0, 0
+		g.schedule(context.Background(), 2, func(context.Context, int) error {
+			mu.Lock()
+			active++
+			maxActive = max(maxActive, active)
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return nil
+		}, func(int, string) {})
+
+		assert.LessOrEqual(t, maxActive, 2)
+	})
+	t.Run("repositories not yet started are skipped once the run is interrupted", func(t *testing.T) {
+		repos := reposWithDeps(map[string][]string{"rds": {"network"}}, "network", "rds", "dns")
+		g, err := buildDepGraph(repos)
+		assert.Nil(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		outcomes := g.schedule(ctx, 1, func(ctx context.Context, i int) error {
+			// simulates a SIGTERM while terraform is running for the first repository
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}, func(int, string) {})
+
+		assert.Equal(t, StatusInterrupted, outcomes[0].status)
+		assert.Equal(t, repoOutcome{status: StatusSkipped, reason: "skipped because the run was interrupted"}, outcomes[1])
+		assert.Equal(t, repoOutcome{status: StatusSkipped, reason: "skipped because the run was interrupted"}, outcomes[2])
+	})
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// ShowState writes the human readable state of a single repository from cfg to out with sensitive values masked,
+// this is the same content that is pushed to the log repository after an apply
+func ShowState(ctx context.Context, logger *slog.Logger, cfg *Input, name string, opts Options, out io.Writer) error {
+	return withRepo(ctx, logger, cfg, name, opts, func(e *Executor, _ *tfexec.Terraform, repo Repo, _ *slog.Logger) error {
+		state, err := e.showRaw(ctx, e.tfDir(repo), tfBinary(repo))
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, MaskSensitiveStateValues(state))
+		return err
+	})
+}
+
+// ForceUnlock releases the state lock with the supplied ID of a single repository from cfg,
+// e.g. when terraform was killed before it was able to release the lock itself
+func ForceUnlock(ctx context.Context, logger *slog.Logger, cfg *Input, name string, lockID string, opts Options) error {
+	return withRepo(ctx, logger, cfg, name, opts, func(_ *Executor, tf *tfexec.Terraform, _ Repo, logger *slog.Logger) error {
+		defer logTfOutput(tf, logger)()
+		logger.Info("Releasing state lock", "lock_id", lockID)
+		return tf.ForceUnlock(ctx, lockID)
+	})
+}
+
+// clones the repository with the supplied name, generates its vault files and initializes terraform
+// before handing it to fn. Everything is cleaned up once fn returns
+func withRepo(ctx context.Context, logger *slog.Logger, cfg *Input, name string, opts Options,
+	fn func(e *Executor, tf *tfexec.Terraform, repo Repo, logger *slog.Logger) error) error {
+	i := slices.IndexFunc(cfg.Repos, func(r Repo) bool { return r.Name == name })
+	if i < 0 {
+		return fmt.Errorf("repository '%s' is not defined in the config", name)
+	}
+	repo := cfg.Repos[i]
+	err := errors.Join(validateRepo(repo)...)
+	if err != nil {
+		return fmt.Errorf("repository '%s' is invalid:\n%w", name, err)
+	}
+	logger = repoLogger(logger, repo)
+
+	e, vaultClient, err := newExecutor(ctx, logger, opts)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(opts.Workdir, FolderPerm)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(opts.Workdir)
+	defer e.cleanup(repo, logger)
+
+	e.clones, err = openCloneCache(opts.GitCacheDir)
+	if err != nil {
+		return err
+	}
+	defer e.clones.close()
+
+	logger.Info("Cloning repository")
+	auth, err := e.gitAuth(ctx, repo, vaultClient)
+	if err != nil {
+		return err
+	}
+	commit, err := e.clones.cloneRepo(ctx, repo, e.repoDir(repo), auth, logger)
+	if err != nil {
+		return err
+	}
+	logger = logger.With("sha", commit.Hash.String())
+	logger.Info("Checked out ref")
+	// submodule URLs are read from the commit, which has to be verified before they're fetched with credentials
+	if e.requiresSignedRef(repo) {
+		err = e.verifyCommit(ctx, commit, vaultClient)
+		if err != nil {
+			return err
+		}
+		logger.Info("Verified commit signature")
+	}
+	_, err = e.clones.checkoutSubmodules(ctx, repo, e.repoDir(repo), commit, e.submoduleAuth(ctx, repo, vaultClient), logger)
+	if err != nil {
+		return err
+	}
+
+	creds, _, err := e.generateVaultFiles(ctx, repo, vaultClient, logger)
+	if err != nil {
+		return err
+	}
+
+	tf, err := e.newTerraform(repo)
+	if err != nil {
+		return err
+	}
+	logger.Info("Initializing terraform config")
+	err = e.init(ctx, tf)
+	if err != nil {
+		return err
+	}
+	err = tf.SetEnv(combineEnvVariables(creds))
+	if err != nil {
+		return err
+	}
+
+	return fn(e, tf, repo, logger)
+}
@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	metricsNamespace = "tf_repo_executor"
+	// job label used when pushing to a Pushgateway
+	metricsJob = "terraform-repo-executor"
+	// how long pushing metrics may take, independent of whether the run was interrupted
+	metricsPushTimeout = 30 * time.Second
+)
+
+// vault operations tracked by the vault errors counter
+const (
+	vaultOpRead  = "read"
+	vaultOpWrite = "write"
+)
+
+// metrics are collected throughout a run and exported once it has finished. They are registered on
+// their own registry so that only executor metrics end up in the textfile or Pushgateway
+type metrics struct {
+	registry        *prometheus.Registry
+	reposProcessed  *prometheus.CounterVec
+	repoSucceeded   *prometheus.GaugeVec
+	phaseDuration   *prometheus.HistogramVec
+	resourceChanges *prometheus.GaugeVec
+	vaultErrors     *prometheus.CounterVec
+	gitPushFailures prometheus.Counter
+	lastRun         prometheus.Gauge
+	// repos observed in this run, each is pushed to a group of its own
+	repos []string
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		reposProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "repos_processed_total",
+			Help:      "Number of repositories processed by outcome.",
+		}, []string{"outcome"}),
+		repoSucceeded: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "repo_succeeded",
+			Help:      "Whether the last run of a repository succeeded (1) or not (0).",
+		}, []string{"repo"}),
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "phase_duration_seconds",
+			Help:      "Time spent in each phase of processing a repository.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		}, []string{"phase"}),
+		resourceChanges: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "resource_changes",
+			Help:      "Number of resources the plan of a repository adds, changes or destroys.",
+		}, []string{"repo", "change"}),
+		vaultErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "vault_errors_total",
+			Help:      "Number of failed Vault reads and writes.",
+		}, []string{"operation"}),
+		gitPushFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "git_push_failures_total",
+			Help:      "Number of failed pushes to the state log repository.",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Unix timestamp of when the last run finished.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.reposProcessed,
+		m.repoSucceeded,
+		m.phaseDuration,
+		m.resourceChanges,
+		m.vaultErrors,
+		m.gitPushFailures,
+		m.lastRun,
+	)
+	return m
+}
+
+// records the outcome of every repository in the report
+func (m *metrics) observeReport(report Report) {
+	for _, repo := range report.Repos {
+		m.reposProcessed.WithLabelValues(string(repo.Status)).Inc()
+		m.repos = append(m.repos, repo.Name)
+
+		succeeded := 0.0
+		if repo.Status == StatusSucceeded || repo.Status == StatusUnchanged {
+			succeeded = 1
+		}
+		m.repoSucceeded.WithLabelValues(repo.Name).Set(succeeded)
+
+		for phase, seconds := range repo.Durations {
+			m.phaseDuration.WithLabelValues(string(phase)).Observe(seconds)
+		}
+
+		if repo.Changes != nil {
+			m.resourceChanges.WithLabelValues(repo.Name, "add").Set(float64(repo.Changes.Add))
+			m.resourceChanges.WithLabelValues(repo.Name, "change").Set(float64(repo.Changes.Change))
+			m.resourceChanges.WithLabelValues(repo.Name, "destroy").Set(float64(repo.Changes.Destroy))
+		}
+	}
+	m.lastRun.Set(float64(report.FinishedAt.Unix()))
+}
+
+// writes the metrics in the Prometheus text format for the node exporter textfile collector
+func (m *metrics) writeTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, m.registry)
+}
+
+// pushes the metrics to a Pushgateway compatible endpoint. Metrics of a repository are pushed to a group
+// of that repository so that a run of only some repositories, e.g. with --repo or in server mode, keeps
+// the metrics of all others. Run wide metrics replace those of the previous run
+func (m *metrics) push(ctx context.Context, url string) error {
+	// metrics should still be pushed when the run was interrupted
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metricsPushTimeout)
+	defer cancel()
+
+	err := push.New(url, metricsJob).Gatherer(m.gatherer("")).PushContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, repo := range m.repos {
+		err = push.New(url, metricsJob).Grouping("repo", repo).Gatherer(m.gatherer(repo)).PushContext(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to push metrics of %s: %w", repo, err)
+		}
+	}
+	return nil
+}
+
+// returns the metrics without a repo label when repo is empty, otherwise only the metrics of repo.
+// The repo label is removed from the latter as it is part of the grouping key
+func (m *metrics) gatherer(repo string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := m.registry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		var gathered []*dto.MetricFamily
+		for _, family := range families {
+			family.Metric = slices.DeleteFunc(family.Metric, func(metric *dto.Metric) bool {
+				i := slices.IndexFunc(metric.Label, func(l *dto.LabelPair) bool { return l.GetName() == "repo" })
+				if i < 0 {
+					return repo != ""
+				}
+				if metric.Label[i].GetValue() != repo {
+					return true
+				}
+				// the labels are shared with the collector and must not be modified
+				metric.Label = slices.Delete(slices.Clone(metric.Label), i, i+1)
+				return false
+			})
+			if len(family.Metric) > 0 {
+				gathered = append(gathered, family)
+			}
+		}
+		return gathered, nil
+	})
+}
@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var metricsReport = Report{
+	FinishedAt: time.Unix(1722541497, 0),
+	Repos: []RepoResult{
+		{
+			Name:      repoName,
+			Status:    StatusSucceeded,
+			Durations: map[Phase]float64{PhaseClone: 2, PhaseApply: 90},
+			Changes:   &PlanChanges{Add: 1, Change: 2, Destroy: 3},
+		},
+		{
+			Name:        "b-repo",
+			Status:      StatusFailed,
+			FailedPhase: PhaseInit,
+			Durations:   map[Phase]float64{PhaseClone: 1, PhaseInit: 4},
+		},
+	},
+}
+
+func TestObserveReport(t *testing.T) {
+	m := newMetrics()
+	m.observeReport(metricsReport)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.reposProcessed.WithLabelValues("succeeded")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.reposProcessed.WithLabelValues("failed")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.repoSucceeded.WithLabelValues(repoName)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.repoSucceeded.WithLabelValues("b-repo")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.resourceChanges.WithLabelValues(repoName, "destroy")))
+	// repos without a plan do not report resource changes
+	assert.Equal(t, 3, testutil.CollectAndCount(m.resourceChanges))
+	assert.Equal(t, 1722541497.0, testutil.ToFloat64(m.lastRun))
+
+	expected := `
+		# HELP tf_repo_executor_phase_duration_seconds Time spent in each phase of processing a repository.
+		# TYPE tf_repo_executor_phase_duration_seconds histogram
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="1"} 0
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="5"} 0
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="15"} 0
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="30"} 0
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="60"} 0
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="120"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="300"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="600"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="1200"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="1800"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="3600"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="apply",le="+Inf"} 1
+		tf_repo_executor_phase_duration_seconds_sum{phase="apply"} 90
+		tf_repo_executor_phase_duration_seconds_count{phase="apply"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="1"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="5"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="15"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="30"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="60"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="120"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="300"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="600"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="1200"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="1800"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="3600"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="clone",le="+Inf"} 2
+		tf_repo_executor_phase_duration_seconds_sum{phase="clone"} 3
+		tf_repo_executor_phase_duration_seconds_count{phase="clone"} 2
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="1"} 0
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="5"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="15"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="30"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="60"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="120"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="300"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="600"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="1200"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="1800"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="3600"} 1
+		tf_repo_executor_phase_duration_seconds_bucket{phase="init",le="+Inf"} 1
+		tf_repo_executor_phase_duration_seconds_sum{phase="init"} 4
+		tf_repo_executor_phase_duration_seconds_count{phase="init"} 1
+	`
+	err := testutil.GatherAndCompare(m.registry, strings.NewReader(expected), metricsNamespace+"_phase_duration_seconds")
+	assert.Nil(t, err)
+}
+
+func TestWriteTextfile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metrics")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	m := newMetrics()
+	m.observeReport(metricsReport)
+	m.vaultErrors.WithLabelValues(vaultOpRead).Inc()
+	m.gitPushFailures.Inc()
+
+	path := fmt.Sprintf("%s/tf-repo.prom", tmpDir)
+	err = m.writeTextfile(path)
+	assert.Nil(t, err)
+
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), `tf_repo_executor_repos_processed_total{outcome="failed"} 1`)
+	assert.Contains(t, string(raw), `tf_repo_executor_repo_succeeded{repo="b-repo"} 0`)
+	assert.Contains(t, string(raw), `tf_repo_executor_vault_errors_total{operation="read"} 1`)
+	assert.Contains(t, string(raw), `tf_repo_executor_git_push_failures_total 1`)
+}
+
+func TestPushMetrics(t *testing.T) {
+	bodies := map[string]string{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		raw, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		bodies[r.URL.Path] = string(raw)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	m := newMetrics()
+	m.observeReport(metricsReport)
+
+	// metrics are still pushed after the run has been interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := m.push(ctx, gateway.URL)
+	assert.Nil(t, err)
+
+	// run wide metrics replace the job group
+	assert.Len(t, bodies, 3)
+	run := bodies["/metrics/job/terraform-repo-executor"]
+	assert.Contains(t, run, "tf_repo_executor_repos_processed_total")
+	assert.NotContains(t, run, "tf_repo_executor_repo_succeeded")
+
+	// every repo has a group of its own, so that other repos are kept
+	repo := bodies["/metrics/job/terraform-repo-executor/repo/"+repoName]
+	assert.Contains(t, repo, "tf_repo_executor_repo_succeeded")
+	assert.Contains(t, repo, "tf_repo_executor_resource_changes")
+	assert.NotContains(t, repo, "b-repo")
+	assert.NotContains(t, repo, "tf_repo_executor_repos_processed_total")
+	assert.Contains(t, bodies, "/metrics/job/terraform-repo-executor/repo/b-repo")
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// log formats supported by NewLogger
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// NewLogger creates a structured logger writing to out in the requested format
+func NewLogger(out io.Writer, format string) (*slog.Logger, error) {
+	switch strings.ToLower(format) {
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(out, nil)), nil
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(out, nil)), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format '%s', expected '%s' or '%s'", format, LogFormatJSON, LogFormatText)
+	}
+}
+
+// creates a logger annotating every line with the repository being processed
+func repoLogger(logger *slog.Logger, repo Repo) *slog.Logger {
+	return logger.With("repo", repo.Name, "ref", repo.Ref)
+}
+
+// lineWriter buffers output until a full line is available and then hands that line to emit,
+// this allows the output of concurrently running terraform processes to be logged line by line
+type lineWriter struct {
+	mu   sync.Mutex
+	emit func(line string)
+	buf  []byte
+}
+
+func newLineWriter(emit func(line string)) *lineWriter {
+	return &lineWriter{
+		emit: emit,
+	}
+}
+
+// creates a lineWriter logging every line of terraform output on the supplied stream
+func newTfOutputWriter(logger *slog.Logger, stream string) *lineWriter {
+	return newLineWriter(func(line string) {
+		logger.Info(line, "stream", stream)
+	})
+}
+
+// Write implements io.Writer and only emits complete lines
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits any remaining partial line
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
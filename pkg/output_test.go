@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	t.Run("json logger includes repo attributes", func(t *testing.T) {
+		var out bytes.Buffer
+		logger, err := NewLogger(&out, "JSON")
+		assert.Nil(t, err)
+
+		repoLogger(logger, repoWithoutExplicitBucketSettings).Info("Processing repository", "phase", PhaseClone)
+
+		var line map[string]any
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+		assert.Equal(t, "Processing repository", line["msg"])
+		assert.Equal(t, repoName, line["repo"])
+		assert.Equal(t, repoRef, line["ref"])
+		assert.Equal(t, "clone", line["phase"])
+	})
+
+	t.Run("text logger is supported", func(t *testing.T) {
+		var out bytes.Buffer
+		logger, err := NewLogger(&out, LogFormatText)
+		assert.Nil(t, err)
+
+		logger.Info("hello", "repo", repoName)
+
+		assert.Contains(t, out.String(), `msg=hello repo=a-repo`)
+	})
+
+	t.Run("unknown format returns error", func(t *testing.T) {
+		_, err := NewLogger(&bytes.Buffer{}, "xml")
+
+		assert.Error(t, err)
+	})
+}
+
+func TestLineWriter(t *testing.T) {
+	t.Run("only complete lines are emitted", func(t *testing.T) {
+		var lines []string
+		w := newLineWriter(func(line string) {
+			lines = append(lines, line)
+		})
+
+		_, err := w.Write([]byte("Plan: 1 to add, "))
+		assert.Nil(t, err)
+		assert.Empty(t, lines)
+
+		_, err = w.Write([]byte("0 to change, 0 to destroy.\nApply"))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"Plan: 1 to add, 0 to change, 0 to destroy."}, lines)
+
+		w.Flush()
+		assert.Equal(t, []string{"Plan: 1 to add, 0 to change, 0 to destroy.", "Apply"}, lines)
+	})
+
+	t.Run("lines from concurrent terraform processes are logged separately", func(t *testing.T) {
+		var out bytes.Buffer
+		logger, err := NewLogger(&out, LogFormatJSON)
+		assert.Nil(t, err)
+
+		var wg sync.WaitGroup
+		for _, name := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := newTfOutputWriter(repoLogger(logger, Repo{Name: name}), "stdout")
+				for range 100 {
+					w.Write([]byte("some "))
+					w.Write([]byte("terraform output\n"))
+				}
+			}()
+		}
+		wg.Wait()
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		assert.Len(t, lines, 300)
+		for _, line := range lines {
+			var decoded map[string]any
+			assert.Nil(t, json.Unmarshal([]byte(line), &decoded))
+			assert.Equal(t, "some terraform output", decoded["msg"])
+			assert.Equal(t, "stdout", decoded["stream"])
+			assert.Contains(t, []any{"a", "b", "c"}, decoded["repo"])
+		}
+	})
+}
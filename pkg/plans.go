@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// PlanVars are used to render the human-readable plan of a dry run in markdown
+type PlanVars struct {
+	RepoName string
+	RepoURL  string
+	RepoSHA  string
+	Changes  PlanChanges
+	Plan     string
+}
+
+//go:embed templates/plan.tmpl
+var planTmplData string
+
+// GitLab rejects notes longer than 1,000,000 characters, longer plans are truncated
+const maxPublishedPlanSize = 900_000
+
+// publishes the masked human-readable plan of a dry run to the destination selected with `publish_plans`.
+// Failures are only logged as the plan itself succeeded
+func (e *Executor) publishPlan(ctx context.Context, tf *tfexec.Terraform, repo Repo, planFile string, logger *slog.Logger, result *RepoResult) error {
+	if e.publishPlans == "" || result.Changes == nil {
+		return nil
+	}
+	return result.phase(PhasePlanPublish, logger, func(logger *slog.Logger) error {
+		// the plan is only published in its masked form
+		tf.SetStdout(io.Discard)
+		tf.SetStderr(io.Discard)
+		plan, err := tf.ShowPlanFileRaw(ctx, planFile)
+		if err == nil {
+			err = e.writePlan(ctx, repo, result, plan)
+		}
+		if err != nil {
+			logger.Error("Unable to publish plan", "destination", e.publishPlans, "error", err)
+		}
+		return nil
+	})
+}
+
+// renders the plan as markdown and writes it to `plans/<name>.md` in the state sink or as a note on the merge request
+func (e *Executor) writePlan(ctx context.Context, repo Repo, result *RepoResult, plan string) error {
+	plan = MaskSensitivePlanValues(plan)
+	if len(plan) > maxPublishedPlanSize {
+		cut := strings.LastIndex(plan[:maxPublishedPlanSize], "\n")
+		plan = fmt.Sprintf("%s\n... truncated, the full plan is %d bytes long", plan[:max(cut, 0)], len(plan))
+	}
+
+	var markdown bytes.Buffer
+	tmpl, err := template.New("plan").Parse(planTmplData)
+	if err != nil {
+		return fmt.Errorf("could not template markdown: '%s'", err)
+	}
+	err = tmpl.Execute(&markdown, PlanVars{
+		RepoName: repo.Name,
+		RepoURL:  repo.URL,
+		RepoSHA:  result.SHA,
+		Changes:  *result.Changes,
+		Plan:     plan,
+	})
+	if err != nil {
+		return fmt.Errorf("could not template markdown: '%s'", err)
+	}
+
+	if e.publishPlans == PublishPlansMergeRequest {
+		return e.gitlab.CreateMergeRequestNote(ctx, e.mergeRequest.Project, e.mergeRequest.IID, markdown.String())
+	}
+	e.stateMu.Lock()
+	defer e.stateMu.Unlock()
+	e.pendingPlans = append(e.pendingPlans, stateUpdate{
+		repo:  repo,
+		sha:   result.SHA,
+		files: map[string][]byte{"plans/" + repo.Name + ".md": markdown.Bytes()},
+	})
+	return nil
+}
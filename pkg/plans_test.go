@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/gitlab"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePlan(t *testing.T) {
+	const sha = "d82b3cb292d91ec2eb26fc282d751555088819f3"
+	repo := Repo{Name: "a", URL: "https://gitlab.example.com/group/a"}
+	result := &RepoResult{SHA: sha, Changes: &PlanChanges{Add: 1}}
+	plan := " <= data \"vault_generic_secret\" \"creds\" {\n      + data = \"OHNO\"\n    }\n\nPlan: 1 to add, 0 to change, 0 to destroy."
+
+	assertMarkdown := func(t *testing.T, markdown string) {
+		assert.Contains(t, markdown, "# a\n[Upstream SHA: "+sha+"](https://gitlab.example.com/group/a/-/commit/"+sha+")")
+		assert.Contains(t, markdown, "Plan: 1 to add, 0 to change, 0 to destroy.")
+		assert.Contains(t, markdown, "[REDACTED VAULT SECRET]")
+		assert.NotContains(t, markdown, "OHNO")
+	}
+
+	t.Run("state sink", func(t *testing.T) {
+		e := &Executor{publishPlans: PublishPlansStateSink}
+		err := e.writePlan(t.Context(), repo, result, plan)
+		assert.NoError(t, err)
+
+		assert.Empty(t, e.pendingState)
+		assert.Len(t, e.pendingPlans, 1)
+		assert.Equal(t, sha, e.pendingPlans[0].sha)
+		assertMarkdown(t, string(e.pendingPlans[0].files["plans/a.md"]))
+	})
+
+	t.Run("merge request", func(t *testing.T) {
+		var path string
+		var note map[string]string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.EscapedPath()
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&note))
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+		client, err := gitlab.NewClient(server.URL, "token")
+		assert.NoError(t, err)
+
+		e := &Executor{
+			publishPlans: PublishPlansMergeRequest,
+			mergeRequest: MergeRequest{Project: "service/app-interface", IID: 42},
+			gitlab:       client,
+		}
+		err = e.writePlan(t.Context(), repo, result, plan)
+		assert.NoError(t, err)
+
+		assert.Empty(t, e.pendingPlans)
+		assert.Equal(t, "/api/v4/projects/service%2Fapp-interface/merge_requests/42/notes", path)
+		assertMarkdown(t, note["body"])
+	})
+}
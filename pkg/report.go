@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// RepoStatus is the final state of a repository once a run has finished
+type RepoStatus string
+
+// possible states of a repository in a report
+const (
+	StatusSucceeded   RepoStatus = "succeeded"
+	StatusFailed      RepoStatus = "failed"
+	StatusSkipped     RepoStatus = "skipped"
+	StatusInterrupted RepoStatus = "interrupted"
+	// nothing the repo depends on changed since its last apply so terraform wasn't run
+	StatusUnchanged RepoStatus = "unchanged"
+)
+
+// Action is the terraform operation performed on a repository
+type Action string
+
+// terraform operations performed by the executor
+const (
+	ActionPlan    Action = "plan"
+	ActionApply   Action = "apply"
+	ActionDestroy Action = "destroy"
+)
+
+// Phase is a step in processing a single repository
+type Phase string
+
+// phases of processing a repository, in the order they happen
+const (
+	PhaseClone       Phase = "clone"
+	PhaseVerify      Phase = "verify"
+	PhaseVault       Phase = "vault"
+	PhaseInit        Phase = "init"
+	PhasePlan        Phase = "plan"
+	PhasePlanPublish Phase = "plan_publish"
+	PhaseApply       Phase = "apply"
+	PhaseOutputWrite Phase = "output_write"
+	PhaseStatePush   Phase = "state_push"
+)
+
+// PlanChanges counts the resource changes of a terraform plan in the same way as the
+// `Plan: X to add, Y to change, Z to destroy` summary line
+type PlanChanges struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+}
+
+// Submodule is a submodule checked out for a repository, the path of nested submodules is relative to the
+// root of the repository as well
+type Submodule struct {
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	SHA  string `json:"sha"`
+}
+
+// RepoResult is the outcome of processing a single repository
+type RepoResult struct {
+	Name          string            `json:"name"`
+	Ref           string            `json:"ref"`
+	SHA           string            `json:"sha,omitempty"`
+	Submodules    []Submodule       `json:"submodules,omitempty"`
+	InputsVersion int               `json:"inputs_version,omitempty"`
+	Action        Action            `json:"action"`
+	Status        RepoStatus        `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	StateError    string            `json:"state_error,omitempty"`
+	SkipReason    string            `json:"skip_reason,omitempty"`
+	FailedPhase   Phase             `json:"failed_phase,omitempty"`
+	Durations     map[Phase]float64 `json:"durations_seconds"`
+	Changes       *PlanChanges      `json:"changes,omitempty"`
+}
+
+// Report is the machine-readable summary of a run that is written to REPORT_FILE
+type Report struct {
+	DryRun     bool         `json:"dry_run"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Repos      []RepoResult `json:"repos"`
+}
+
+func newRepoResult(repo Repo, dryRun bool) *RepoResult {
+	action := ActionApply
+	switch {
+	case dryRun:
+		action = ActionPlan
+	case repo.Delete:
+		action = ActionDestroy
+	}
+	return &RepoResult{
+		Name:      repo.Name,
+		Ref:       repo.Ref,
+		Action:    action,
+		Durations: make(map[Phase]float64),
+	}
+}
+
+// runs fn as the given phase of processing the repository, recording how long it took and
+// remembering the phase as the one that failed if fn returns an error.
+// fn receives a logger annotating every line with the phase
+func (r *RepoResult) phase(p Phase, logger *slog.Logger, fn func(logger *slog.Logger) error) error {
+	start := time.Now()
+	err := fn(logger.With("phase", p))
+	r.Durations[p] += time.Since(start).Seconds()
+	if err != nil && r.FailedPhase == "" {
+		r.FailedPhase = p
+	}
+	return err
+}
+
+// records the final outcome of the repository once the scheduler is done with it
+func (r *RepoResult) complete(outcome repoOutcome) {
+	// unchanged repos were processed successfully without running terraform
+	if r.Status == StatusUnchanged && outcome.status == StatusSucceeded {
+		return
+	}
+	r.Status = outcome.status
+	r.SkipReason = outcome.reason
+	if outcome.err != nil {
+		r.Error = outcome.err.Error()
+	}
+}
+
+// counts the managed resources that a plan would add, change or destroy, with replacements
+// counting as both an addition and a destruction
+func countPlanChanges(plan *tfjson.Plan) *PlanChanges {
+	changes := &PlanChanges{}
+	for _, rc := range plan.ResourceChanges {
+		if rc.Mode == tfjson.DataResourceMode || rc.Change == nil {
+			continue
+		}
+		actions := rc.Change.Actions
+		switch {
+		case actions.Replace():
+			changes.Add++
+			changes.Destroy++
+		case actions.Create():
+			changes.Add++
+		case actions.Update():
+			changes.Change++
+		case actions.Delete():
+			changes.Destroy++
+		}
+	}
+	return changes
+}
+
+// writes the report as indented JSON to path
+func writeReport(report Report, path string) error {
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+)
+
+func resourceChange(mode tfjson.ResourceMode, actions ...tfjson.Action) *tfjson.ResourceChange {
+	return &tfjson.ResourceChange{
+		Mode:   mode,
+		Change: &tfjson.Change{Actions: actions},
+	}
+}
+
+func TestCountPlanChanges(t *testing.T) {
+	plan := &tfjson.Plan{
+		ResourceChanges: []*tfjson.ResourceChange{
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionCreate),
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionCreate),
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionUpdate),
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionDelete),
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionDelete, tfjson.ActionCreate),
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionCreate, tfjson.ActionDelete),
+			resourceChange(tfjson.ManagedResourceMode, tfjson.ActionNoop),
+			resourceChange(tfjson.DataResourceMode, tfjson.ActionRead),
+		},
+	}
+
+	assert.Equal(t, &PlanChanges{Add: 4, Change: 1, Destroy: 3}, countPlanChanges(plan))
+}
+
+func TestNewRepoResult(t *testing.T) {
+	repo := repoWithoutExplicitBucketSettings
+
+	assert.Equal(t, ActionPlan, newRepoResult(repo, true).Action)
+	assert.Equal(t, ActionApply, newRepoResult(repo, false).Action)
+
+	repo.Delete = true
+	assert.Equal(t, ActionPlan, newRepoResult(repo, true).Action)
+	assert.Equal(t, ActionDestroy, newRepoResult(repo, false).Action)
+}
+
+func TestRepoResultPhase(t *testing.T) {
+	result := newRepoResult(repoWithoutExplicitBucketSettings, false)
+	logger := slog.New(slog.DiscardHandler)
+
+	err := result.phase(PhaseClone, logger, func(*slog.Logger) error { return nil })
+	assert.Nil(t, err)
+
+	failure := errors.New("no valid credential sources found")
+	err = result.phase(PhaseInit, logger, func(*slog.Logger) error { return failure })
+	assert.Equal(t, failure, err)
+
+	// only the first failing phase is reported
+	err = result.phase(PhaseStatePush, logger, func(*slog.Logger) error { return errors.New("push rejected") })
+	assert.Error(t, err)
+
+	result.complete(repoOutcome{status: StatusFailed, err: failure})
+
+	assert.Equal(t, PhaseInit, result.FailedPhase)
+	assert.Equal(t, StatusFailed, result.Status)
+	assert.Equal(t, "no valid credential sources found", result.Error)
+	assert.Contains(t, result.Durations, PhaseClone)
+	assert.Contains(t, result.Durations, PhaseInit)
+	assert.NotContains(t, result.Durations, PhaseApply)
+}
+
+func TestRepoResultCompleteUnchanged(t *testing.T) {
+	result := newRepoResult(repoWithoutExplicitBucketSettings, false)
+	result.Status = StatusUnchanged
+	result.SkipReason = "unchanged since the last apply of d82b3cb292d91ec2eb26fc282d751555088819f3"
+
+	result.complete(repoOutcome{status: StatusSucceeded})
+	assert.Equal(t, StatusUnchanged, result.Status)
+	assert.Equal(t, "unchanged since the last apply of d82b3cb292d91ec2eb26fc282d751555088819f3", result.SkipReason)
+}
+
+func TestWriteReport(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "report")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	startedAt := time.Date(2024, 8, 1, 19, 44, 57, 0, time.UTC)
+	report := Report{
+		DryRun:     false,
+		StartedAt:  startedAt,
+		FinishedAt: startedAt.Add(time.Minute),
+		Repos: []RepoResult{
+			{
+				Name:      repoName,
+				Ref:       repoRef,
+				Action:    ActionApply,
+				Status:    StatusSucceeded,
+				Durations: map[Phase]float64{PhaseApply: 42.5},
+				Changes:   &PlanChanges{Add: 1},
+			},
+			{
+				Name:       "b-repo",
+				Ref:        repoRef,
+				Action:     ActionApply,
+				Status:     StatusSkipped,
+				SkipReason: "skipped because a-repo failed",
+				Durations:  map[Phase]float64{},
+			},
+		},
+	}
+
+	path := fmt.Sprintf("%s/report.json", tmpDir)
+	err = writeReport(report, path)
+	assert.Nil(t, err)
+
+	raw, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	expected := `{
+  "dry_run": false,
+  "started_at": "2024-08-01T19:44:57Z",
+  "finished_at": "2024-08-01T19:45:57Z",
+  "repos": [
+    {
+      "name": "a-repo",
+      "ref": "d82b3cb292d91ec2eb26fc282d751555088819f3",
+      "action": "apply",
+      "status": "succeeded",
+      "durations_seconds": {
+        "apply": 42.5
+      },
+      "changes": {
+        "add": 1,
+        "change": 0,
+        "destroy": 0
+      }
+    },
+    {
+      "name": "b-repo",
+      "ref": "d82b3cb292d91ec2eb26fc282d751555088819f3",
+      "action": "apply",
+      "status": "skipped",
+      "skip_reason": "skipped because a-repo failed",
+      "durations_seconds": {}
+    }
+  ]
+}`
+	assert.JSONEq(t, expected, string(raw))
+
+	var decoded Report
+	assert.Nil(t, json.Unmarshal(raw, &decoded))
+	assert.Equal(t, report, decoded)
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// JSON Schema dialect of the generated schema
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonSchema is the subset of JSON Schema needed to describe the config
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 any                    `json:"type,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// Schema generates the JSON Schema of the config accepted by ParseInput from the Input struct and the
+// structs it references. Fields tagged with `jsonschema:"required"` are required, all other fields may
+// be omitted or null, and unknown keys are rejected just like ParseInput does
+func Schema() ([]byte, error) {
+	defs := map[string]*jsonSchema{}
+	root, err := structSchema(reflect.TypeFor[Input](), defs)
+	if err != nil {
+		return nil, err
+	}
+	root.Schema = schemaDialect
+	root.Title = "terraform-repo-executor config"
+	root.Defs = defs
+
+	out, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// describes a struct as an object with one property per yaml key, nested structs are added to defs
+func structSchema(t reflect.Type, defs map[string]*jsonSchema) (*jsonSchema, error) {
+	additionalProperties := false
+	s := &jsonSchema{
+		Type:                 "object",
+		Properties:           map[string]*jsonSchema{},
+		AdditionalProperties: &additionalProperties,
+	}
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		fieldSchema, err := typeSchema(field.Type, defs)
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %w", t.Name(), field.Name, err)
+		}
+
+		if field.Tag.Get("jsonschema") == "required" {
+			s.Required = append(s.Required, name)
+		} else {
+			fieldSchema = nullable(fieldSchema)
+		}
+		s.Properties[name] = fieldSchema
+	}
+	return s, nil
+}
+
+// describes a single go type, structs are referenced from defs
+func typeSchema(t reflect.Type, defs map[string]*jsonSchema) (*jsonSchema, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return &jsonSchema{Type: "string"}, nil
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}, nil
+	case reflect.Slice:
+		items, err := typeSchema(t.Elem(), defs)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSchema{Type: "array", Items: items}, nil
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			// reserve the name first in case of recursive types
+			defs[t.Name()] = nil
+			def, err := structSchema(t, defs)
+			if err != nil {
+				return nil, err
+			}
+			defs[t.Name()] = def
+		}
+		return &jsonSchema{Ref: "#/$defs/" + t.Name()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+// Qontract Reconcile renders unset optional values as null
+func nullable(s *jsonSchema) *jsonSchema {
+	if s.Ref != "" {
+		return &jsonSchema{AnyOf: []*jsonSchema{s, {Type: "null"}}}
+	}
+	s.Type = []string{s.Type.(string), "null"}
+	return s
+}
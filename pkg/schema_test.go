@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema(t *testing.T) {
+	t.Run("published schema is up to date", func(t *testing.T) {
+		schema, err := Schema()
+		assert.Nil(t, err)
+
+		published, err := os.ReadFile("../schema/input.schema.json")
+		assert.Nil(t, err)
+		assert.Equal(t, string(published), string(schema), "run `make schema` to regenerate the published schema")
+	})
+
+	t.Run("required fields are not nullable", func(t *testing.T) {
+		schema, err := structSchema(reflect.TypeFor[Repo](), map[string]*jsonSchema{})
+		assert.Nil(t, err)
+
+		assert.Contains(t, schema.Required, "ref")
+		assert.Equal(t, "string", schema.Properties["ref"].Type)
+		assert.NotContains(t, schema.Required, "bucket")
+		assert.Equal(t, []string{"string", "null"}, schema.Properties["bucket"].Type)
+		assert.False(t, *schema.AdditionalProperties)
+	})
+}
@@ -0,0 +1,474 @@
+// Package server exposes the executor as a long-running HTTP service that accepts runs as jobs
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/app-sre/terraform-repo-executor/pkg"
+)
+
+// JobStatus is the state of a submitted job
+type JobStatus string
+
+// states a job goes through
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	// the server shut down before the job was run
+	JobCancelled JobStatus = "cancelled"
+)
+
+// defaults for Options that are not set
+const (
+	DefaultQueueSize    = 10
+	DefaultRetainedJobs = 100
+)
+
+// maximum accepted size of a submitted config
+const maxInputSize = 10 << 20
+
+// RunFunc performs a run for a submitted config, pkg.RunInput in production
+type RunFunc func(ctx context.Context, logger *slog.Logger, cfg *pkg.Input, opts pkg.Options) (*pkg.Report, error)
+
+// Options configure the job server
+type Options struct {
+	// executor options applied to every job, each job gets its own subdirectory of Workdir
+	Executor pkg.Options
+	// how many jobs can wait to be run before new submissions are rejected
+	QueueSize int
+	// how many finished jobs are kept in memory for status queries
+	RetainedJobs int
+	// bearer token required by every request except the health probes, all requests are rejected without one
+	Token string
+}
+
+// Job is a single submitted run and its outcome
+type Job struct {
+	ID          string      `json:"id"`
+	Status      JobStatus   `json:"status"`
+	DryRun      bool        `json:"dry_run"`
+	Error       string      `json:"error,omitempty"`
+	SubmittedAt time.Time   `json:"submitted_at"`
+	StartedAt   *time.Time  `json:"started_at,omitempty"`
+	FinishedAt  *time.Time  `json:"finished_at,omitempty"`
+	Report      *pkg.Report `json:"report,omitempty"`
+
+	input *pkg.Input
+	logs  *logBuffer
+}
+
+// Server queues submitted jobs and runs them one after another
+type Server struct {
+	opts   Options
+	logger *slog.Logger
+	run    RunFunc
+
+	queue chan *Job
+	// closed once the worker has started, used for readiness
+	started chan struct{}
+
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	finished []string // IDs of finished jobs, oldest first
+	stopped  bool     // set once the worker has stopped, no more jobs are accepted
+}
+
+// New creates a server that runs jobs with run
+func New(logger *slog.Logger, opts Options, run RunFunc) *Server {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.RetainedJobs < 1 {
+		opts.RetainedJobs = DefaultRetainedJobs
+	}
+	return &Server{
+		opts:    opts,
+		logger:  logger,
+		run:     run,
+		queue:   make(chan *Job, opts.QueueSize),
+		started: make(chan struct{}),
+		jobs:    make(map[string]*Job),
+	}
+}
+
+// Handler returns the HTTP API of the server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.authenticated(s.submitJob))
+	mux.HandleFunc("GET /jobs", s.authenticated(s.listJobs))
+	mux.HandleFunc("GET /jobs/{id}", s.authenticated(s.getJob))
+	mux.HandleFunc("GET /jobs/{id}/results", s.authenticated(s.getJobResults))
+	mux.HandleFunc("GET /jobs/{id}/logs", s.authenticated(s.getJobLogs))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /readyz", s.ready)
+	return mux
+}
+
+// rejects requests that don't carry the token of the server as bearer token, jobs run with the credentials of
+// the executor and their logs may contain secrets
+func (s *Server) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.opts.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ListenAndServe serves the HTTP API on addr and runs queued jobs until ctx is cancelled.
+// A running job is interrupted the same way as a one-shot run receiving a SIGTERM
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		s.Work(ctx)
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		s.logger.Info("Listening for jobs", "addr", addr)
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Info("Shutting down, waiting for running job to be interrupted")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	<-workerDone
+	return err
+}
+
+// Work runs queued jobs one at a time until ctx is cancelled. Jobs still queued then are cancelled
+func (s *Server) Work(ctx context.Context) {
+	close(s.started)
+	for {
+		select {
+		case <-ctx.Done():
+			s.cancelQueued()
+			return
+		case job := <-s.queue:
+			if ctx.Err() != nil {
+				// the job was picked although ctx was cancelled as well
+				s.cancelQueued(job)
+				return
+			}
+			s.runJob(ctx, job)
+		}
+	}
+}
+
+func (s *Server) runJob(ctx context.Context, job *Job) {
+	now := time.Now()
+	s.update(func() {
+		job.Status = JobRunning
+		job.StartedAt = &now
+	})
+
+	// job logs go to the server log with all attributes of the server logger, e.g. the session ID, and to the job
+	// so that they can be retrieved via the API
+	logger := s.logger.With("job_id", job.ID)
+	logger = slog.New(teeHandler{
+		logger.Handler(),
+		slog.NewJSONHandler(job.logs, nil).WithAttrs([]slog.Attr{slog.String("job_id", job.ID)}),
+	})
+	logger.Info("Starting job", "repos", len(job.input.Repos))
+
+	// every job gets its own workdir so that nothing is left over from previous jobs
+	opts := s.opts.Executor
+	opts.Workdir = filepath.Join(s.opts.Executor.Workdir, job.ID)
+	report, err := func() (*pkg.Report, error) {
+		err := os.MkdirAll(s.opts.Executor.Workdir, pkg.FolderPerm)
+		if err != nil {
+			return nil, err
+		}
+		return s.run(ctx, logger, job.input, opts)
+	}()
+
+	finished := time.Now()
+	s.update(func() {
+		job.FinishedAt = &finished
+		job.Report = report
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = JobSucceeded
+		}
+	})
+	if err != nil {
+		logger.Error("Job failed", "error", err)
+	} else {
+		logger.Info("Job succeeded")
+	}
+
+	s.retire(job.ID)
+}
+
+// stops accepting jobs and cancels the given and all queued jobs as they won't be run anymore
+func (s *Server) cancelQueued(jobs ...*Job) {
+	now := time.Now()
+	s.update(func() {
+		s.stopped = true
+		// nothing is queued once stopped is set, so the queue can be drained without blocking
+		for len(s.queue) > 0 {
+			jobs = append(jobs, <-s.queue)
+		}
+		for _, job := range jobs {
+			job.Status = JobCancelled
+			job.Error = "server shut down before the job was run"
+			job.FinishedAt = &now
+		}
+	})
+	for _, job := range jobs {
+		s.logger.Warn("Cancelled queued job", "job_id", job.ID)
+		s.retire(job.ID)
+	}
+}
+
+// applies fn while holding the lock guarding all jobs
+func (s *Server) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// forgets the oldest finished jobs once more than RetainedJobs have finished
+func (s *Server) retire(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = append(s.finished, id)
+	for len(s.finished) > s.opts.RetainedJobs {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+func (s *Server) submitJob(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInputSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unable to read request body: %w", err))
+		return
+	}
+	cfg, err := pkg.ParseInput(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid config: %w", err))
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	job := &Job{
+		ID:          id,
+		Status:      JobQueued,
+		DryRun:      cfg.DryRun,
+		SubmittedAt: time.Now(),
+		input:       cfg,
+		logs:        &logBuffer{},
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		writeError(w, http.StatusServiceUnavailable, errors.New("server is shutting down"))
+		return
+	}
+	select {
+	case s.queue <- job:
+		s.jobs[id] = job
+	default:
+		s.mu.Unlock()
+		writeError(w, http.StatusServiceUnavailable, errors.New("job queue is full, try again later"))
+		return
+	}
+	snapshot := *job
+	s.mu.Unlock()
+
+	s.logger.Info("Queued job", "job_id", id, "repos", len(cfg.Repos))
+	w.Header().Set("Location", "/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		snapshot := *job
+		// reports can be large, they are available per job
+		snapshot.Report = nil
+		jobs = append(jobs, snapshot)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.snapshot(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) getJobResults(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.snapshot(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	results := []pkg.RepoResult{}
+	if job.Report != nil {
+		results = job.Report.Repos
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *Server) getJobLogs(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.snapshot(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	w.Write(job.logs.Bytes())
+}
+
+func (s *Server) ready(w http.ResponseWriter, _ *http.Request) {
+	select {
+	case <-s.started:
+	default:
+		writeError(w, http.StatusServiceUnavailable, errors.New("worker not started"))
+		return
+	}
+	if len(s.queue) == cap(s.queue) {
+		writeError(w, http.StatusServiceUnavailable, errors.New("job queue is full"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// returns a copy of the job that is safe to use without holding the lock
+func (s *Server) snapshot(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate job ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// logBuffer collects the log lines of a job while it may be read concurrently
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Bytes returns a copy of everything written so far
+func (b *logBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// teeHandler passes every log record to all of its handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, record.Level) {
+			errs = append(errs, h.Handle(ctx, record.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/app-sre/terraform-repo-executor/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+dry_run: true
+repos:
+- name: a-repo
+  repository: https://gitlab.myorg.com/some-gl-group/project_a
+  project_path: prod/networking
+  ref: d82b3cb292d91ec2eb26fc282d751555088819f3
+  delete: false
+  aws_creds:
+    path: terraform/creds/prod-acount
+    version: 4
+`
+
+// bearer token of test servers
+const testToken = "s3cr3t"
+
+func newTestServer(t *testing.T, opts Options, run RunFunc) (*Server, *httptest.Server) {
+	opts.Executor.Workdir = t.TempDir()
+	opts.Token = testToken
+	s := New(slog.New(slog.DiscardHandler), opts, run)
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// sends a request with token as bearer token unless it's empty
+func request(t *testing.T, method string, url string, token string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	return resp
+}
+
+func submit(t *testing.T, ts *httptest.Server, body string) (*http.Response, Job) {
+	resp := request(t, http.MethodPost, ts.URL+"/jobs", testToken, body)
+	defer resp.Body.Close()
+
+	var job Job
+	if resp.StatusCode == http.StatusAccepted {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&job))
+	}
+	return resp, job
+}
+
+func getJSON(t *testing.T, url string, v any) int {
+	resp := request(t, http.MethodGet, url, testToken, "")
+	defer resp.Body.Close()
+	if v != nil {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func waitForStatus(t *testing.T, ts *httptest.Server, id string, status JobStatus) Job {
+	var job Job
+	assert.Eventually(t, func() bool {
+		job = Job{}
+		getJSON(t, ts.URL+"/jobs/"+id, &job)
+		return job.Status == status
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestJobs(t *testing.T) {
+	t.Run("submitted job is run and its results and logs are available", func(t *testing.T) {
+		var workdir string
+		s, ts := newTestServer(t, Options{}, func(_ context.Context, logger *slog.Logger, cfg *pkg.Input, opts pkg.Options) (*pkg.Report, error) {
+			workdir = opts.Workdir
+			logger.Info("Processing repository", "repo", cfg.Repos[0].Name)
+			return &pkg.Report{
+				DryRun: cfg.DryRun,
+				Repos: []pkg.RepoResult{
+					{Name: cfg.Repos[0].Name, Status: pkg.StatusSucceeded},
+				},
+			}, nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Work(ctx)
+
+		resp, job := submit(t, ts, testConfig)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "/jobs/"+job.ID, resp.Header.Get("Location"))
+		assert.True(t, job.DryRun)
+
+		job = waitForStatus(t, ts, job.ID, JobSucceeded)
+		assert.Empty(t, job.Error)
+		assert.NotNil(t, job.StartedAt)
+		assert.NotNil(t, job.FinishedAt)
+		assert.True(t, strings.HasSuffix(workdir, job.ID))
+
+		var results []pkg.RepoResult
+		assert.Equal(t, http.StatusOK, getJSON(t, ts.URL+"/jobs/"+job.ID+"/results", &results))
+		assert.Equal(t, []pkg.RepoResult{{Name: "a-repo", Status: pkg.StatusSucceeded}}, results)
+
+		resp = request(t, http.MethodGet, ts.URL+"/jobs/"+job.ID+"/logs", testToken, "")
+		defer resp.Body.Close()
+		logs := json.NewDecoder(resp.Body)
+		var line map[string]any
+		assert.Nil(t, logs.Decode(&line))
+		assert.Equal(t, "Starting job", line["msg"])
+		line = nil
+		assert.Nil(t, logs.Decode(&line))
+		assert.Equal(t, "Processing repository", line["msg"])
+		assert.Equal(t, "a-repo", line["repo"])
+		assert.Equal(t, job.ID, line["job_id"])
+
+		var jobs []Job
+		assert.Equal(t, http.StatusOK, getJSON(t, ts.URL+"/jobs", &jobs))
+		assert.Len(t, jobs, 1)
+		assert.Nil(t, jobs[0].Report)
+	})
+
+	t.Run("job logs carry the attributes of the server logger", func(t *testing.T) {
+		out := &logBuffer{}
+		logger := slog.New(slog.NewJSONHandler(out, nil)).With("session_id", "abc")
+		s := New(logger, Options{Executor: pkg.Options{Workdir: t.TempDir()}, Token: testToken}, func(_ context.Context, logger *slog.Logger, _ *pkg.Input, _ pkg.Options) (*pkg.Report, error) {
+			logger.Info("Processing repository")
+			return &pkg.Report{}, nil
+		})
+		cfg, err := pkg.ParseInput([]byte(testConfig))
+		assert.Nil(t, err)
+		s.runJob(context.Background(), &Job{ID: "1234", input: cfg, logs: &logBuffer{}})
+
+		lines := json.NewDecoder(bytes.NewReader(out.Bytes()))
+		for lines.More() {
+			var line map[string]any
+			assert.Nil(t, lines.Decode(&line))
+			assert.Equal(t, "abc", line["session_id"])
+			assert.Equal(t, "1234", line["job_id"])
+		}
+	})
+
+	t.Run("queued jobs are cancelled on shutdown", func(t *testing.T) {
+		running := make(chan struct{})
+		var once sync.Once
+		s, ts := newTestServer(t, Options{}, func(ctx context.Context, _ *slog.Logger, _ *pkg.Input, _ pkg.Options) (*pkg.Report, error) {
+			once.Do(func() { close(running) })
+			<-ctx.Done()
+			return &pkg.Report{}, ctx.Err()
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Work(ctx)
+		}()
+
+		_, first := submit(t, ts, testConfig)
+		<-running
+		_, second := submit(t, ts, testConfig)
+		cancel()
+		<-done
+
+		waitForStatus(t, ts, first.ID, JobFailed)
+		second = waitForStatus(t, ts, second.ID, JobCancelled)
+		assert.NotEmpty(t, second.Error)
+		assert.NotNil(t, second.FinishedAt)
+
+		resp, _ := submit(t, ts, testConfig)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	t.Run("failed run marks job as failed", func(t *testing.T) {
+		s, ts := newTestServer(t, Options{}, func(context.Context, *slog.Logger, *pkg.Input, pkg.Options) (*pkg.Report, error) {
+			return &pkg.Report{}, errors.New("errors encountered within 1/1 targets: a-repo")
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Work(ctx)
+
+		_, job := submit(t, ts, testConfig)
+		job = waitForStatus(t, ts, job.ID, JobFailed)
+		assert.Equal(t, "errors encountered within 1/1 targets: a-repo", job.Error)
+	})
+
+	t.Run("invalid config is rejected", func(t *testing.T) {
+		_, ts := newTestServer(t, Options{}, nil)
+
+		resp, _ := submit(t, ts, "repos: [")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("submissions are rejected once the queue is full", func(t *testing.T) {
+		_, ts := newTestServer(t, Options{QueueSize: 1}, nil)
+
+		resp, _ := submit(t, ts, testConfig)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		resp, _ = submit(t, ts, testConfig)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, http.StatusServiceUnavailable, getJSON(t, ts.URL+"/readyz", nil))
+	})
+
+	t.Run("unknown job is not found", func(t *testing.T) {
+		_, ts := newTestServer(t, Options{}, nil)
+
+		assert.Equal(t, http.StatusNotFound, getJSON(t, ts.URL+"/jobs/unknown", nil))
+		assert.Equal(t, http.StatusNotFound, getJSON(t, ts.URL+"/jobs/unknown/logs", nil))
+	})
+
+	t.Run("only the most recent finished jobs are retained", func(t *testing.T) {
+		s, ts := newTestServer(t, Options{RetainedJobs: 1}, func(context.Context, *slog.Logger, *pkg.Input, pkg.Options) (*pkg.Report, error) {
+			return &pkg.Report{}, nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Work(ctx)
+
+		_, first := submit(t, ts, testConfig)
+		waitForStatus(t, ts, first.ID, JobSucceeded)
+		_, second := submit(t, ts, testConfig)
+		waitForStatus(t, ts, second.ID, JobSucceeded)
+
+		assert.Equal(t, http.StatusNotFound, getJSON(t, ts.URL+"/jobs/"+first.ID, nil))
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	routes := []struct{ method, path string }{
+		{http.MethodPost, "/jobs"},
+		{http.MethodGet, "/jobs"},
+		{http.MethodGet, "/jobs/0123456789abcdef"},
+		{http.MethodGet, "/jobs/0123456789abcdef/results"},
+		{http.MethodGet, "/jobs/0123456789abcdef/logs"},
+	}
+
+	t.Run("requests without the token are rejected", func(t *testing.T) {
+		s, ts := newTestServer(t, Options{}, nil)
+
+		for _, route := range routes {
+			for _, token := range []string{"", "wrong", testToken + "x"} {
+				resp := request(t, route.method, ts.URL+route.path, token, testConfig)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, route.method+" "+route.path)
+				assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+			}
+		}
+		assert.Empty(t, s.jobs)
+		assert.Empty(t, s.queue)
+	})
+
+	t.Run("the token has to be sent as bearer token", func(t *testing.T) {
+		_, ts := newTestServer(t, Options{}, nil)
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/jobs", nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Basic "+testToken)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("all requests are rejected without a configured token", func(t *testing.T) {
+		s := New(slog.New(slog.DiscardHandler), Options{}, nil)
+		ts := httptest.NewServer(s.Handler())
+		defer ts.Close()
+
+		for _, token := range []string{"", " "} {
+			resp := request(t, http.MethodGet, ts.URL+"/jobs", token, "")
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+}
+
+func TestHealth(t *testing.T) {
+	s, ts := newTestServer(t, Options{}, nil)
+
+	// probes don't require the token
+	probe := func(path string) int {
+		resp := request(t, http.MethodGet, ts.URL+path, "", "")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, probe("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe("/readyz"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Work(ctx)
+
+	assert.Eventually(t, func() bool {
+		return probe("/readyz") == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+}
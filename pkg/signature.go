@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	vault "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// keys of the vault secret holding the public keys that commits may be signed with
+const (
+	SigningKeysGPG = "gpg_keys"
+	SigningKeysSSH = "ssh_keys"
+)
+
+// armor of SSH signatures as created by `ssh-keygen -Y sign`, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+const (
+	sshSignatureBegin = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureEnd   = "-----END SSH SIGNATURE-----"
+	// git signs commits in the git namespace so that the signature can't be reused for something else
+	sshSignatureNamespace = "git"
+	sshSignatureVersion   = 1
+)
+
+var sshSignatureMagic = [6]byte{'S', 'S', 'H', 'S', 'I', 'G'}
+
+// signingKeys are the allowlisted public keys the commits of repos requiring signed refs must be signed with
+type signingKeys struct {
+	// armored OpenPGP keyring
+	gpg string
+	ssh []ssh.PublicKey
+}
+
+// parses the signing keys secret, `gpg_keys` holds armored OpenPGP public keys and `ssh_keys` one public
+// key per line in authorized_keys or allowed_signers format
+func parseSigningKeys(secret vaultutil.VaultKvData) (*signingKeys, error) {
+	gpgKeys, _ := secret[SigningKeysGPG].(string)
+	sshKeys, _ := secret[SigningKeysSSH].(string)
+	if gpgKeys == "" && sshKeys == "" {
+		return nil, fmt.Errorf("secret must contain `%s` or `%s`", SigningKeysGPG, SigningKeysSSH)
+	}
+
+	keys := &signingKeys{gpg: gpgKeys}
+	scanner := bufio.NewScanner(strings.NewReader(sshKeys))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := parseAllowedSigner(text)
+		if err != nil {
+			return nil, fmt.Errorf("`%s` line %d: %w", SigningKeysSSH, line, err)
+		}
+		keys.ssh = append(keys.ssh, key)
+	}
+	return keys, nil
+}
+
+// parses a line of an authorized_keys or an allowed_signers file, the latter starts with the principals
+func parseAllowedSigner(line string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err == nil {
+		return key, nil
+	}
+	if _, rest, ok := strings.Cut(line, " "); ok {
+		key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(rest))
+	}
+	return key, err
+}
+
+// returns the signing keys, they're read from vault once per run
+func (e *Executor) signingKeys(ctx context.Context, vaultClient *vault.Client) (*signingKeys, error) {
+	e.keysMu.Lock()
+	defer e.keysMu.Unlock()
+	if e.keys != nil {
+		return e.keys, nil
+	}
+
+	secret, err := vaultutil.GetVaultTfSecret(ctx, vaultClient, e.signingKeysSecret, e.mountVersions)
+	if err != nil {
+		e.metrics.vaultErrors.WithLabelValues(vaultOpRead).Inc()
+		return nil, fmt.Errorf("unable to read signing keys: %w", err)
+	}
+	keys, err := parseSigningKeys(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing keys at '%s': %w", e.signingKeysSecret.Path, err)
+	}
+	e.keys = keys
+	return keys, nil
+}
+
+// verifies that commit is signed with one of the signing keys
+func (e *Executor) verifyCommit(ctx context.Context, commit *object.Commit, vaultClient *vault.Client) error {
+	keys, err := e.signingKeys(ctx, vaultClient)
+	if err != nil {
+		return err
+	}
+	return keys.verify(commit)
+}
+
+// verifies that commit is signed with one of the keys, either with GPG or SSH as configured with git's gpg.format
+func (k *signingKeys) verify(commit *object.Commit) error {
+	if commit.PGPSignature == "" {
+		return fmt.Errorf("commit %s is not signed", commit.Hash)
+	}
+
+	if strings.HasPrefix(commit.PGPSignature, sshSignatureBegin) {
+		if len(k.ssh) == 0 {
+			return fmt.Errorf("commit %s is signed with an SSH key but no `%s` are allowed", commit.Hash, SigningKeysSSH)
+		}
+		message, err := signedCommitMessage(commit)
+		if err != nil {
+			return err
+		}
+		err = verifySSHSignature(k.ssh, commit.PGPSignature, message)
+		if err != nil {
+			return fmt.Errorf("SSH signature of commit %s is not valid: %w", commit.Hash, err)
+		}
+		return nil
+	}
+
+	if k.gpg == "" {
+		return fmt.Errorf("commit %s is signed with a GPG key but no `%s` are allowed", commit.Hash, SigningKeysGPG)
+	}
+	_, err := commit.Verify(k.gpg)
+	if err != nil {
+		return fmt.Errorf("GPG signature of commit %s is not valid: %w", commit.Hash, err)
+	}
+	return nil
+}
+
+// returns the commit as it was signed, i.e. without the signature
+func signedCommitMessage(commit *object.Commit) ([]byte, error) {
+	encoded := &plumbing.MemoryObject{}
+	err := commit.EncodeWithoutSignature(encoded)
+	if err != nil {
+		return nil, err
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// wire format of an SSH signature
+type sshSignature struct {
+	MagicPreamble [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// data that is actually signed by the key of an SSH signature
+type sshSignedData struct {
+	MagicPreamble [6]byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// verifies an armored SSH signature of message made in the git namespace by one of the allowed keys
+func verifySSHSignature(allowed []ssh.PublicKey, armored string, message []byte) error {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(armored), sshSignatureBegin)
+	if ok {
+		encoded, ok = strings.CutSuffix(encoded, sshSignatureEnd)
+	}
+	if !ok {
+		return errors.New("malformed signature armor")
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	var sig sshSignature
+	err = ssh.Unmarshal(blob, &sig)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	if sig.MagicPreamble != sshSignatureMagic || sig.Version != sshSignatureVersion {
+		return errors.New("unsupported signature format")
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return fmt.Errorf("signature is made for namespace '%s' instead of '%s'", sig.Namespace, sshSignatureNamespace)
+	}
+
+	pub, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return fmt.Errorf("malformed public key: %w", err)
+	}
+	if !containsKey(allowed, pub) {
+		return fmt.Errorf("key %s is not allowed", ssh.FingerprintSHA256(pub))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported hash algorithm '%s'", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	var signature ssh.Signature
+	err = ssh.Unmarshal(sig.Signature, &signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	signed := ssh.Marshal(sshSignedData{
+		MagicPreamble: sshSignatureMagic,
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})
+	return pub.Verify(signed, &signature)
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// signs commits the way `git commit -S` does with gpg.format=ssh
+type testSSHSigner struct {
+	signer    ssh.Signer
+	namespace string
+}
+
+func (s testSSHSigner) Sign(message io.Reader) ([]byte, error) {
+	msg, err := io.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha512.Sum512(msg)
+	sig, err := s.signer.Sign(rand.Reader, ssh.Marshal(sshSignedData{
+		MagicPreamble: sshSignatureMagic,
+		Namespace:     s.namespace,
+		HashAlgorithm: "sha512",
+		Hash:          hash[:],
+	}))
+	if err != nil {
+		return nil, err
+	}
+	blob := ssh.Marshal(sshSignature{
+		MagicPreamble: sshSignatureMagic,
+		Version:       sshSignatureVersion,
+		PublicKey:     s.signer.PublicKey().Marshal(),
+		Namespace:     s.namespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})
+	return []byte(sshSignatureBegin + "\n" + base64.StdEncoding.EncodeToString(blob) + "\n" + sshSignatureEnd + "\n"), nil
+}
+
+func testSSHKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	return signer
+}
+
+func testGPGKey(t *testing.T) (*openpgp.Entity, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, entity.Serialize(w))
+	assert.NoError(t, w.Close())
+	return entity, buf.String()
+}
+
+func TestVerifyCommitSignature(t *testing.T) {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	commit := func(opts git.CommitOptions) *object.Commit {
+		opts.Author = &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)}
+		opts.AllowEmptyCommits = true
+		hash, err := wt.Commit("commit", &opts)
+		assert.NoError(t, err)
+		c, err := repo.CommitObject(hash)
+		assert.NoError(t, err)
+		return c
+	}
+
+	sshKey := testSSHKey(t)
+	otherSSHKey := testSSHKey(t)
+	gpgKey, gpgKeyRing := testGPGKey(t)
+	otherGPGKey, _ := testGPGKey(t)
+
+	keys, err := parseSigningKeys(map[string]any{
+		SigningKeysGPG: gpgKeyRing,
+		SigningKeysSSH: "# comment\n\nalice@example.com " + string(ssh.MarshalAuthorizedKey(sshKey.PublicKey())),
+	})
+	assert.NoError(t, err)
+	sshOnly, err := parseSigningKeys(map[string]any{SigningKeysSSH: string(ssh.MarshalAuthorizedKey(sshKey.PublicKey()))})
+	assert.NoError(t, err)
+
+	unsigned := commit(git.CommitOptions{})
+	sshSigned := commit(git.CommitOptions{Signer: testSSHSigner{sshKey, "git"}})
+	otherSSHSigned := commit(git.CommitOptions{Signer: testSSHSigner{otherSSHKey, "git"}})
+	wrongNamespace := commit(git.CommitOptions{Signer: testSSHSigner{sshKey, "file"}})
+	gpgSigned := commit(git.CommitOptions{SignKey: gpgKey})
+	otherGPGSigned := commit(git.CommitOptions{SignKey: otherGPGKey})
+
+	testCases := []struct {
+		name   string
+		keys   *signingKeys
+		commit *object.Commit
+		err    string
+	}{
+		{name: "ssh", keys: keys, commit: sshSigned},
+		{name: "gpg", keys: keys, commit: gpgSigned},
+		{name: "unsigned", keys: keys, commit: unsigned, err: "commit " + unsigned.Hash.String() + " is not signed"},
+		{
+			name:   "ssh key not allowed",
+			keys:   keys,
+			commit: otherSSHSigned,
+			err:    "SSH signature of commit " + otherSSHSigned.Hash.String() + " is not valid: key " + ssh.FingerprintSHA256(otherSSHKey.PublicKey()) + " is not allowed",
+		},
+		{
+			name:   "ssh signature for another namespace",
+			keys:   keys,
+			commit: wrongNamespace,
+			err:    "SSH signature of commit " + wrongNamespace.Hash.String() + " is not valid: signature is made for namespace 'file' instead of 'git'",
+		},
+		{
+			name:   "gpg key not allowed",
+			keys:   keys,
+			commit: otherGPGSigned,
+			err:    "GPG signature of commit " + otherGPGSigned.Hash.String() + " is not valid: openpgp: signature made by unknown entity",
+		},
+		{
+			name:   "no gpg keys allowed",
+			keys:   sshOnly,
+			commit: gpgSigned,
+			err:    "commit " + gpgSigned.Hash.String() + " is signed with a GPG key but no `gpg_keys` are allowed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.keys.verify(tc.commit)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+
+	t.Run("tampered commit", func(t *testing.T) {
+		tampered := *sshSigned
+		tampered.Message = "tampered"
+		assert.ErrorContains(t, keys.verify(&tampered), "SSH signature of commit")
+	})
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	_, err := parseSigningKeys(map[string]any{})
+	assert.EqualError(t, err, "secret must contain `gpg_keys` or `ssh_keys`")
+
+	_, err = parseSigningKeys(map[string]any{SigningKeysSSH: "# comment\nnot a key"})
+	assert.ErrorContains(t, err, "`ssh_keys` line 2: ")
+}
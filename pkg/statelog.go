@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// AppliedState is written to `<name>.json` in the state sink next to the state of every applied repo. It
+// doesn't contain a timestamp so that applying the same commit again doesn't create a new commit
+type AppliedState struct {
+	Name          string      `json:"name"`
+	Repository    string      `json:"repository"`
+	SHA           string      `json:"sha"`
+	Submodules    []Submodule `json:"submodules,omitempty"`
+	ConfigHash    string      `json:"config_hash,omitempty"`
+	InputsVersion int         `json:"inputs_version,omitempty"`
+}
+
+// returns what is recorded in the state sink for the apply of repo
+func newAppliedState(repo Repo, result *RepoResult) AppliedState {
+	return AppliedState{
+		Name:          repo.Name,
+		Repository:    repo.URL,
+		SHA:           result.SHA,
+		Submodules:    result.Submodules,
+		ConfigHash:    configHash(repo),
+		InputsVersion: result.InputsVersion,
+	}
+}
+
+// how long writing the state may take after the run was interrupted
+const stateFlushTimeout = 5 * time.Minute
+
+// the rendered state of an applied repo, written to the state sink at the end of the run
+type stateUpdate struct {
+	repo  Repo
+	sha   string
+	files map[string][]byte
+}
+
+// writes the state of all repos applied during the run as a single change, i.e. a single commit for the git
+// sink. If that fails the state of each repo is written on its own so that one broken update doesn't lose the
+// others. The state of repos applied before an interruption is still written. Returns the errors of the repos
+// whose state couldn't be written by their name
+func (e *Executor) flushState(ctx context.Context, logger *slog.Logger) map[string]error {
+	e.stateMu.Lock()
+	updates := e.pendingState
+	e.pendingState = nil
+	e.stateMu.Unlock()
+	return e.writeUpdates(ctx, updates, "state", stateMessage, logger)
+}
+
+// writes the plans published to the state sink during a dry run the same way as the state. Failures are
+// only logged as the plans themselves succeeded
+func (e *Executor) flushPlans(ctx context.Context, logger *slog.Logger) {
+	e.stateMu.Lock()
+	plans := e.pendingPlans
+	e.pendingPlans = nil
+	e.stateMu.Unlock()
+	e.writeUpdates(ctx, plans, "plan", planMessage, logger)
+}
+
+// writes updates to the state sink as a single change, falling back to a change per repo, and returns the
+// errors of the repos whose update couldn't be written. What names the kind of the updates in the log
+func (e *Executor) writeUpdates(ctx context.Context, updates []stateUpdate, what string, message func([]stateUpdate) string, logger *slog.Logger) map[string]error {
+	if len(updates) == 0 {
+		return nil
+	}
+	slices.SortFunc(updates, func(a, b stateUpdate) int { return cmp.Compare(a.repo.Name, b.repo.Name) })
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stateFlushTimeout)
+	defer cancel()
+
+	files := map[string][]byte{}
+	for _, u := range updates {
+		maps.Copy(files, u.files)
+	}
+	err := e.sink.write(ctx, files, message(updates))
+	if err == nil {
+		return nil
+	}
+
+	if len(updates) > 1 {
+		logger.Warn("Unable to write the "+what+" of all repos at once, writing it per repo", "repos", len(updates), "error", err)
+	}
+	errs := map[string]error{}
+	for _, u := range updates {
+		if len(updates) > 1 {
+			err = e.sink.write(ctx, u.files, message([]stateUpdate{u}))
+		}
+		if err != nil {
+			repoLogger(logger, u.repo).Error("Unable to write "+what, "error", err)
+			errs[u.repo.Name] = err
+		}
+	}
+	return errs
+}
+
+// describes a change of the state sink, listing the name and applied commit of every repo
+func stateMessage(updates []stateUpdate) string {
+	now := time.Now().Format(time.RFC3339)
+	if len(updates) == 1 {
+		return fmt.Sprintf("%s @ %s: %s", updates[0].repo.Name, updates[0].sha, now)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d repos: %s\n\n", len(updates), now)
+	for _, u := range updates {
+		fmt.Fprintf(&b, "%s @ %s\n", u.repo.Name, u.sha)
+	}
+	return b.String()
+}
+
+// describes a change of the state sink with published plans
+func planMessage(updates []stateUpdate) string {
+	return "Plans of " + stateMessage(updates)
+}
+
+// returns a hash of the config of repo apart from its ref, so that e.g. a new tf_version or other
+// vault paths are detected as a change
+func configHash(repo Repo) string {
+	repo.Ref = ""
+	repo.Force = false
+	// a struct of strings, bools and ints always marshals
+	raw, _ := json.Marshal(repo)
+	return fmt.Sprintf("%x", sha256.Sum256(raw))
+}
+
+// the SHA in the markdown rendered from templates/show.tmpl, used for repos that were last applied
+// before the metadata file was written
+var stateSHARegexp = regexp.MustCompile(`\[Upstream SHA: ([0-9a-f]{40})\]`)
+
+// returns the last apply of repo according to the state sink, nil if the repo has never been applied.
+// Only the SHA is known for repos last applied before `<name>.json` was written
+func (e *Executor) lastApplied(ctx context.Context, repo Repo) (*AppliedState, error) {
+	contents, err := e.sink.read(ctx, repo.Name+".json")
+	if err == nil {
+		var applied AppliedState
+		err = json.Unmarshal(contents, &applied)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s.json in state sink: %w", repo.Name, err)
+		}
+		return &applied, nil
+	}
+	if !errors.Is(err, errStateNotFound) {
+		return nil, err
+	}
+
+	contents, err = e.sink.read(ctx, repo.Name+".md")
+	if errors.Is(err, errStateNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if match := stateSHARegexp.FindSubmatch(contents); match != nil {
+		return &AppliedState{Name: repo.Name, Repository: repo.URL, SHA: string(match[1])}, nil
+	}
+	return nil, nil
+}
+
+// refuses to apply a commit that is an ancestor of the commit applied last, e.g. because Qontract Reconcile
+// rendered a stale config, as that would silently revert the infrastructure
+func (e *Executor) checkRollback(ctx context.Context, repo Repo, commit *object.Commit, auth transport.AuthMethod) error {
+	last, err := e.lastApplied(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("unable to determine the last applied commit: %w", err)
+	}
+	if last == nil || last.SHA == "" || last.SHA == commit.Hash.String() {
+		return nil
+	}
+
+	rollback, err := e.clones.isAncestor(ctx, repo, commit, last.SHA, auth)
+	if err != nil {
+		return err
+	}
+	if rollback {
+		return fmt.Errorf("commit %s is older than the last applied commit %s, set `allow_rollback` to apply it anyway", commit.Hash, last.SHA)
+	}
+	return nil
+}
+
+// explains why repo doesn't need to be processed: neither the files terraform reads from the commit, i.e.
+// project_path and its local modules, nor the config of repo or the version of its inputs changed since the
+// last apply. An empty reason means that repo has to be processed
+func (e *Executor) unchangedReason(ctx context.Context, repo Repo, commit *object.Commit, inputsVersion int, auth transport.AuthMethod) (string, error) {
+	last, err := e.lastApplied(ctx, repo)
+	if err != nil || last == nil {
+		return "", err
+	}
+	if last.ConfigHash != configHash(repo) || last.InputsVersion != inputsVersion {
+		return "", nil
+	}
+	// secrets of KV1 mounts aren't versioned so a change can't be detected
+	if repo.TfVariables.Inputs.Path != "" && inputsVersion == 0 {
+		return "", nil
+	}
+
+	if last.SHA != commit.Hash.String() {
+		changed, err := e.clones.changedSince(ctx, repo, commit, last.SHA, auth)
+		if err != nil || changed {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("unchanged since the last apply of %s", last.SHA), nil
+}
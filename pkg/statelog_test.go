@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastApplied(t *testing.T) {
+	const sha = "d82b3cb292d91ec2eb26fc282d751555088819f3"
+	logRepo, _ := testOriginRepo(t, map[string]string{
+		"metadata.json": `{"name": "metadata", "repository": "https://example.com/repo", "sha": "` + sha + `"}`,
+		"legacy.md":     "# legacy\n[Upstream SHA: " + sha + "](https://example.com/repo/-/commit/" + sha + ")\n",
+		"invalid.json":  "{",
+	})
+	e := &Executor{sink: testGitSink(logRepo)}
+
+	testCases := []struct {
+		name string
+		want string
+		err  string
+	}{
+		{name: "metadata", want: sha},
+		{name: "legacy", want: sha},
+		{name: "never-applied"},
+		{name: "invalid", err: "invalid invalid.json in state sink: unexpected end of JSON input"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := e.lastApplied(t.Context(), Repo{Name: tc.name})
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.want == "" {
+				assert.Nil(t, got)
+			} else {
+				assert.Equal(t, tc.want, got.SHA)
+			}
+		})
+	}
+
+	t.Run("empty log repo", func(t *testing.T) {
+		empty := t.TempDir()
+		_, err := git.PlainInit(empty, false)
+		assert.NoError(t, err)
+		e := &Executor{sink: testGitSink(empty)}
+		got, err := e.lastApplied(t.Context(), Repo{Name: "metadata"})
+		assert.NoError(t, err)
+		assert.Nil(t, got)
+	})
+}
+
+func TestCheckRollback(t *testing.T) {
+	origin, first := testOriginRepo(t, map[string]string{"main.tf": ""})
+	second := testCommit(t, origin, nil)
+	third := testCommit(t, origin, nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	logRepo, _ := testOriginRepo(t, map[string]string{
+		"repo.json":      `{"sha": "` + second.String() + `"}`,
+		"rewritten.json": `{"sha": "0123456789012345678901234567890123456789"}`,
+	})
+
+	testCases := []struct {
+		name string
+		repo string
+		ref  string
+		err  string
+	}{
+		{name: "same commit", repo: "repo", ref: second.String()},
+		{name: "newer commit", repo: "repo", ref: third.String()},
+		{
+			name: "older commit",
+			repo: "repo",
+			ref:  first.String(),
+			err:  "commit " + first.String() + " is older than the last applied commit " + second.String() + ", set `allow_rollback` to apply it anyway",
+		},
+		{name: "last applied commit no longer exists", repo: "rewritten", ref: first.String()},
+		{name: "never applied", repo: "new", ref: first.String()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &Executor{sink: testGitSink(logRepo), clones: testCloneCache(t)}
+			repo := Repo{Name: tc.repo, URL: origin, Ref: tc.ref}
+			// the shallow clone of the ref doesn't contain the last applied commit
+			commit, err := e.clones.cloneRepo(t.Context(), repo, filepath.Join(t.TempDir(), tc.repo), nil, logger)
+			assert.NoError(t, err)
+
+			err = e.checkRollback(t.Context(), repo, commit, nil)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUnchangedReason(t *testing.T) {
+	origin, first := testOriginRepo(t, map[string]string{
+		"infra/main.tf":     "module \"a\" {\n  source = \"../modules/a\"\n}\n",
+		"modules/a/main.tf": "",
+		"other/main.tf":     "",
+		"functions/main.tf": "data \"archive_file\" \"lambda\" {\n  source_dir = \"../lambda\"\n}\n",
+		"lambda/handler.py": "",
+	})
+	unrelated := testCommit(t, origin, map[string]string{"other/main.tf": "changed"})
+	moduleChanged := testCommit(t, origin, map[string]string{"modules/a/main.tf": "changed"})
+	lambdaChanged := testCommit(t, origin, map[string]string{"lambda/handler.py": "changed"})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	repo := Repo{Name: "infra", URL: origin, Path: "infra", TfVersion: "1.5.7"}
+	withInputs := repo
+	withInputs.Name = "inputs"
+	withInputs.TfVariables.Inputs.Path = "terraform/inputs"
+	legacy := repo
+	legacy.Name = "legacy"
+	functions := Repo{Name: "functions", URL: origin, Path: "functions", TfVersion: "1.5.7"}
+
+	applied := func(r Repo, inputsVersion int) string {
+		raw, err := json.Marshal(AppliedState{Name: r.Name, SHA: first.String(), ConfigHash: configHash(r), InputsVersion: inputsVersion})
+		assert.NoError(t, err)
+		return string(raw)
+	}
+	logRepo, _ := testOriginRepo(t, map[string]string{
+		"infra.json":     applied(repo, 0),
+		"inputs.json":    applied(withInputs, 3),
+		"functions.json": applied(functions, 0),
+		"legacy.md":      "[Upstream SHA: " + first.String() + "](https://example.com)\n",
+	})
+
+	newVersion := repo
+	newVersion.TfVersion = "1.6.0"
+
+	testCases := []struct {
+		name          string
+		repo          Repo
+		ref           plumbing.Hash
+		inputsVersion int
+		unchanged     bool
+	}{
+		{name: "same commit", repo: repo, ref: first, unchanged: true},
+		{name: "unrelated change", repo: repo, ref: unrelated, unchanged: true},
+		{name: "local module changed", repo: repo, ref: moduleChanged},
+		{name: "file outside of project_path changed", repo: functions, ref: lambdaChanged},
+		{name: "config changed", repo: newVersion, ref: first},
+		{name: "same inputs version", repo: withInputs, ref: unrelated, inputsVersion: 3, unchanged: true},
+		{name: "new inputs version", repo: withInputs, ref: first, inputsVersion: 4},
+		{name: "last applied before config was recorded", repo: legacy, ref: first},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &Executor{sink: testGitSink(logRepo), clones: testCloneCache(t)}
+			tc.repo.Ref = tc.ref.String()
+			commit, err := e.clones.cloneRepo(t.Context(), tc.repo, filepath.Join(t.TempDir(), tc.repo.Name), nil, logger)
+			assert.NoError(t, err)
+
+			reason, err := e.unchangedReason(t.Context(), tc.repo, commit, tc.inputsVersion, nil)
+			assert.NoError(t, err)
+			if tc.unchanged {
+				assert.Equal(t, "unchanged since the last apply of "+first.String(), reason)
+			} else {
+				assert.Empty(t, reason)
+			}
+		})
+	}
+}
+
+// records the writes to a state sink, writes of more than maxFiles files fail
+type testSink struct {
+	maxFiles int
+	err      error
+	files    map[string]string
+	messages []string
+}
+
+func (s *testSink) read(context.Context, string) ([]byte, error) {
+	return nil, errStateNotFound
+}
+
+func (s *testSink) write(_ context.Context, files map[string][]byte, message string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.maxFiles > 0 && len(files) > s.maxFiles {
+		return errors.New("too many files")
+	}
+	for name, contents := range files {
+		s.files[name] = string(contents)
+	}
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func TestFlushState(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	queue := func(e *Executor, names ...string) {
+		for _, name := range names {
+			err := e.queueState(Repo{Name: name, URL: "https://example.com/" + name}, AppliedState{Name: name, SHA: name + "-sha"}, "{}")
+			assert.NoError(t, err)
+		}
+	}
+
+	t.Run("batched", func(t *testing.T) {
+		sink := &testSink{files: map[string]string{}}
+		e := &Executor{sink: sink}
+		queue(e, "b", "a")
+		errs := e.flushState(t.Context(), logger)
+
+		assert.Empty(t, errs)
+		assert.Len(t, sink.messages, 1)
+		assert.Regexp(t, `^2 repos: .+\n\na @ a-sha\nb @ b-sha\n$`, sink.messages[0])
+		assert.ElementsMatch(t, []string{"a.md", "a.json", "b.md", "b.json"}, slices.Collect(maps.Keys(sink.files)))
+		assert.Contains(t, sink.files["a.json"], `"sha": "a-sha"`)
+		assert.Empty(t, e.pendingState)
+	})
+
+	t.Run("per repo fallback", func(t *testing.T) {
+		sink := &testSink{maxFiles: 2, files: map[string]string{}}
+		e := &Executor{sink: sink}
+		queue(e, "b", "a")
+		errs := e.flushState(t.Context(), logger)
+
+		assert.Empty(t, errs)
+		assert.Len(t, sink.messages, 2)
+		assert.Regexp(t, `^a @ a-sha: `, sink.messages[0])
+		assert.Regexp(t, `^b @ b-sha: `, sink.messages[1])
+		assert.Len(t, sink.files, 4)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		sink := &testSink{err: errors.New("push rejected")}
+		e := &Executor{sink: sink}
+		queue(e, "b", "a")
+		errs := e.flushState(t.Context(), logger)
+
+		assert.Equal(t, map[string]error{"a": sink.err, "b": sink.err}, errs)
+	})
+
+	t.Run("plans are written separately", func(t *testing.T) {
+		sink := &testSink{files: map[string]string{}}
+		e := &Executor{sink: sink, publishPlans: PublishPlansStateSink}
+		queue(e, "a")
+		assert.NoError(t, e.writePlan(t.Context(), Repo{Name: "b"}, &RepoResult{SHA: "b-sha", Changes: &PlanChanges{}}, ""))
+
+		errs := e.flushState(t.Context(), logger)
+		assert.Empty(t, errs)
+		assert.Len(t, sink.messages, 1)
+		assert.NotContains(t, sink.files, "plans/b.md")
+
+		e.flushPlans(t.Context(), logger)
+		assert.Len(t, sink.messages, 2)
+		assert.Regexp(t, `^Plans of b @ b-sha: `, sink.messages[1])
+		assert.Contains(t, sink.files, "plans/b.md")
+		assert.Empty(t, e.pendingPlans)
+	})
+
+	t.Run("plan failures don't fail the state", func(t *testing.T) {
+		sink := &testSink{err: errors.New("push rejected")}
+		e := &Executor{sink: sink, publishPlans: PublishPlansStateSink}
+		assert.NoError(t, e.writePlan(t.Context(), Repo{Name: "b"}, &RepoResult{SHA: "b-sha", Changes: &PlanChanges{}}, ""))
+
+		assert.Empty(t, e.flushState(t.Context(), logger))
+		e.flushPlans(t.Context(), logger)
+		assert.Empty(t, e.pendingPlans)
+	})
+
+	t.Run("nothing applied", func(t *testing.T) {
+		sink := &testSink{files: map[string]string{}}
+		e := &Executor{sink: sink}
+		e.flushState(t.Context(), logger)
+		assert.Empty(t, sink.messages)
+	})
+}
@@ -0,0 +1,406 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// kinds of state sinks that can be selected with STATE_SINK
+const (
+	StateSinkGit = "git"
+	StateSinkDir = "dir"
+	StateSinkS3  = "s3"
+)
+
+// default endpoint of the S3 state sink
+const defaultS3Endpoint = "s3.amazonaws.com"
+
+// the git sink pushes this many times before giving up, waiting twice as long after every rejected push
+const (
+	statePushAttempts   = 5
+	statePushRetryDelay = time.Second
+)
+
+// errStateNotFound is returned by stateSink.read for files that were never written
+var errStateNotFound = errors.New("not found")
+
+// stateSink stores the masked state and the applied state of every applied repo, later runs read the
+// applied state back. Files are identified by a slash separated name such as `<name>.json`
+type stateSink interface {
+	// returns the contents of a file, errStateNotFound if it doesn't exist
+	read(ctx context.Context, name string) ([]byte, error)
+	// stores files by their name, message describes the change
+	write(ctx context.Context, files map[string][]byte, message string) error
+}
+
+// creates the state sink selected by opts, the git sink authenticates like any other HTTPS git URL
+func (e *Executor) newStateSink(opts Options, vaultClient *vault.Client) (stateSink, error) {
+	switch opts.StateSink {
+	case StateSinkGit, "":
+		return &gitSink{
+			url:      opts.GitlabLogRepo,
+			username: opts.GitlabUsername,
+			email:    opts.GitEmail,
+			auth: func(ctx context.Context) (transport.AuthMethod, error) {
+				return e.httpAuth(ctx, opts.GitlabLogRepo, vaultClient)
+			},
+			metrics:    e.metrics,
+			retryDelay: statePushRetryDelay,
+		}, nil
+	case StateSinkDir:
+		return &dirSink{dir: opts.StateDir}, nil
+	case StateSinkS3:
+		// credentials are read from the environment, the AWS credentials file or the instance role
+		creds := credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+		return newS3Sink(opts.StateS3Endpoint, opts.StateS3Region, opts.StateS3Bucket, opts.StateS3Prefix, creds)
+	default:
+		return nil, fmt.Errorf("unknown state sink '%s'", opts.StateSink)
+	}
+}
+
+// gitSink commits the files to a git repository, GITLAB_LOG_REPO
+type gitSink struct {
+	url      string
+	username string
+	email    string
+	auth     func(ctx context.Context) (transport.AuthMethod, error)
+	metrics  *metrics
+	// wait before the first retry of a rejected push
+	retryDelay time.Duration
+
+	// the files of the repository are cloned into memory once per run for reading. Repos only read their
+	// own files, which no other repo writes, so the snapshot doesn't go stale
+	mu     sync.Mutex
+	tree   *object.Tree
+	loaded bool
+}
+
+func (s *gitSink) read(ctx context.Context, name string) ([]byte, error) {
+	tree, err := s.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return nil, errStateNotFound
+	}
+	file, err := tree.File(name)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, errStateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(contents), nil
+}
+
+// returns the files of the repository, nil for an empty repository
+func (s *gitSink) snapshot(ctx context.Context) (*object.Tree, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded {
+		return s.tree, nil
+	}
+
+	auth, err := s.auth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), nil, &git.CloneOptions{
+		URL:          s.url,
+		Auth:         auth,
+		Depth:        1,
+		SingleBranch: true,
+	})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		s.loaded = true
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not clone log repo: %w", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	s.tree, err = commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	s.loaded = true
+	return s.tree, nil
+}
+
+// clones the repository, writes the files, commits and pushes them unless nothing changed
+func (s *gitSink) write(ctx context.Context, files map[string][]byte, message string) error {
+	auth, err := s.auth(ctx)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "tf-repo-state")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	gitRepo, err := git.PlainCloneContext(ctx, tmpdir, false, &git.CloneOptions{
+		URL:  s.url,
+		Auth: auth,
+	})
+	if err != nil {
+		return fmt.Errorf("could not clone repo: '%s'", err)
+	}
+	return s.commitAndPush(ctx, gitRepo, tmpdir, files, message, auth)
+}
+
+// commits the files to the clone of the repository in dir and pushes them. A rejected push, e.g. because another
+// run pushed first, is retried with backoff on top of the new remote head. As the files are only written by one
+// repo each, the retried commit is the same as rebasing the rejected one
+func (s *gitSink) commitAndPush(ctx context.Context, gitRepo *git.Repository, dir string, files map[string][]byte, message string, auth transport.AuthMethod) error {
+	wt, err := gitRepo.Worktree()
+	if err != nil {
+		return fmt.Errorf("could not retrieve git worktree: '%s'", err)
+	}
+
+	delay := s.retryDelay
+	for attempt := 1; ; attempt++ {
+		changed, err := s.commit(wt, dir, files, message)
+		if err != nil || !changed {
+			return err
+		}
+
+		err = gitRepo.PushContext(ctx, &git.PushOptions{
+			RemoteName: "origin",
+			Auth:       auth,
+		})
+		if err == nil {
+			return nil
+		}
+		s.metrics.gitPushFailures.Inc()
+		if !retryablePush(err) {
+			return fmt.Errorf("could not push git commit to remote: '%w'", err)
+		}
+		if attempt == statePushAttempts {
+			return fmt.Errorf("could not push git commit to remote after %d attempts: '%s'", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not push git commit to remote: '%s'", err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+
+		err = resetToRemote(ctx, gitRepo, wt, auth)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writes the files to the worktree and commits them, returns false if nothing changed
+func (s *gitSink) commit(wt *git.Worktree, dir string, files map[string][]byte, message string) (bool, error) {
+	err := writeFiles(dir, files)
+	if err != nil {
+		return false, err
+	}
+
+	st, err := wt.Status()
+	if err != nil {
+		return false, fmt.Errorf("could not retrieve worktree status: '%s'", err)
+	}
+	if st.IsClean() {
+		// no need to commit changes if nothing changed
+		return false, nil
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		_, err = wt.Add(name)
+		if err != nil {
+			return false, fmt.Errorf("could not perform git add: '%s'", err)
+		}
+	}
+
+	_, err = wt.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  s.username,
+			Email: s.email,
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not perform git commit: '%s'", err)
+	}
+	return true, nil
+}
+
+// push errors that won't go away by pushing again
+var permanentPushErrors = []error{
+	transport.ErrAuthenticationRequired,
+	transport.ErrAuthorizationFailed,
+	transport.ErrRepositoryNotFound,
+}
+
+func retryablePush(err error) bool {
+	return !slices.ContainsFunc(permanentPushErrors, func(target error) bool { return errors.Is(err, target) })
+}
+
+// fetches the branch of the worktree and resets it to the remote head, dropping the local commit
+func resetToRemote(ctx context.Context, gitRepo *git.Repository, wt *git.Worktree, auth transport.AuthMethod) error {
+	err := gitRepo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("could not fetch log repo: '%s'", err)
+	}
+
+	head, err := gitRepo.Head()
+	if err != nil {
+		return err
+	}
+	remote, err := gitRepo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil {
+		return fmt.Errorf("could not resolve remote branch of log repo: '%s'", err)
+	}
+	err = wt.Reset(&git.ResetOptions{Commit: remote.Hash(), Mode: git.HardReset})
+	if err != nil {
+		return fmt.Errorf("could not reset log repo: '%s'", err)
+	}
+	return nil
+}
+
+// dirSink writes the files to a local directory, e.g. a mounted volume
+type dirSink struct {
+	dir string
+}
+
+func (s *dirSink) read(_ context.Context, name string) ([]byte, error) {
+	contents, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errStateNotFound
+	}
+	return contents, err
+}
+
+func (s *dirSink) write(_ context.Context, files map[string][]byte, _ string) error {
+	return writeFiles(s.dir, files)
+}
+
+// writes files by their slash separated name relative to dir
+func writeFiles(dir string, files map[string][]byte) error {
+	for name, contents := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(file), FolderPerm)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file, contents, 0o644)
+		if err != nil {
+			return fmt.Errorf("could not write '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// s3Sink uploads the files as objects below a prefix of an S3 compatible bucket
+type s3Sink struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// creates an S3 sink, endpoint is a host name such as s3.amazonaws.com or a URL such as http://minio:9000
+// for endpoints without TLS
+func newS3Sink(endpoint string, region string, bucket string, prefix string, creds *credentials.Credentials) (*s3Sink, error) {
+	if bucket == "" {
+		return nil, errors.New("the S3 state sink requires a bucket")
+	}
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	secure := true
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint '%s': %w", endpoint, err)
+		}
+		endpoint, secure = u.Host, u.Scheme != "http"
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint '%s': %w", endpoint, err)
+	}
+	return &s3Sink{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+func (s *s3Sink) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3Sink) read(ctx context.Context, name string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err == nil {
+		defer obj.Close()
+		var contents []byte
+		contents, err = io.ReadAll(obj)
+		if err == nil {
+			return contents, nil
+		}
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, errStateNotFound
+	}
+	return nil, fmt.Errorf("could not read '%s' from bucket '%s': %w", s.key(name), s.bucket, err)
+}
+
+func (s *s3Sink) write(ctx context.Context, files map[string][]byte, _ string) error {
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		contents := files[name]
+		_, err := s.client.PutObject(ctx, s.bucket, s.key(name), bytes.NewReader(contents), int64(len(contents)), minio.PutObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("could not upload '%s' to bucket '%s': %w", s.key(name), s.bucket, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// a git sink for the repository at url that doesn't authenticate
+func testGitSink(url string) *gitSink {
+	return &gitSink{
+		url:      url,
+		username: "bot",
+		email:    "bot@example.com",
+		auth:     func(context.Context) (transport.AuthMethod, error) { return nil, nil },
+		metrics:  newMetrics(),
+	}
+}
+
+// serves objects from memory like an S3 bucket accessed with path style URLs
+func testS3Server(t *testing.T) (*httptest.Server, map[string]string) {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+				body = testDecodeChunks(t, body)
+			}
+			objects[r.URL.Path] = string(body)
+		case http.MethodGet:
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+				return
+			}
+			w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+			io.WriteString(w, object)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, objects
+}
+
+// decodes an aws-chunked body, which consists of `<size>;chunk-signature=<signature>\r\n<data>\r\n` chunks
+func testDecodeChunks(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var data []byte
+	for len(body) > 0 {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		assert.True(t, ok)
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		assert.NoError(t, err)
+		data = append(data, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+	return data
+}
+
+func TestStateSinks(t *testing.T) {
+	origin, _ := testOriginRepo(t, map[string]string{"README.md": ""})
+	bare := t.TempDir()
+	_, err := git.PlainClone(bare, true, &git.CloneOptions{URL: origin})
+	assert.NoError(t, err)
+
+	s3Server, objects := testS3Server(t)
+	s3, err := newS3Sink(s3Server.URL, "us-east-1", "state", "/tf-repo/", credentials.NewStaticV4("key", "secret", ""))
+	assert.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "state")
+
+	// each sink is created twice so that reading doesn't depend on state kept by the sink that wrote
+	sinks := map[string]func() stateSink{
+		StateSinkGit: func() stateSink { return testGitSink(bare) },
+		StateSinkDir: func() stateSink { return &dirSink{dir: dir} },
+		StateSinkS3:  func() stateSink { return s3 },
+	}
+	for name, newSink := range sinks {
+		t.Run(name, func(t *testing.T) {
+			_, err := newSink().read(t.Context(), "a.json")
+			assert.ErrorIs(t, err, errStateNotFound)
+
+			err = newSink().write(t.Context(), map[string][]byte{"a.json": []byte("{}\n"), "plans/a.md": []byte("# a\n")}, "a @ sha")
+			assert.NoError(t, err)
+
+			sink := newSink()
+			contents, err := sink.read(t.Context(), "a.json")
+			assert.NoError(t, err)
+			assert.Equal(t, "{}\n", string(contents))
+			contents, err = sink.read(t.Context(), "plans/a.md")
+			assert.NoError(t, err)
+			assert.Equal(t, "# a\n", string(contents))
+		})
+	}
+
+	assert.Contains(t, objects, "/state/tf-repo/plans/a.md")
+}
+
+func TestGitSinkPushConflict(t *testing.T) {
+	origin, _ := testOriginRepo(t, map[string]string{"README.md": ""})
+	bare := t.TempDir()
+	_, err := git.PlainClone(bare, true, &git.CloneOptions{URL: origin})
+	assert.NoError(t, err)
+
+	sink := testGitSink(bare)
+	sink.retryDelay = time.Millisecond
+	dir := t.TempDir()
+	gitRepo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: bare})
+	assert.NoError(t, err)
+
+	// another run pushes after the clone, so the first push is rejected
+	err = testGitSink(bare).write(t.Context(), map[string][]byte{"b.json": []byte("{}\n")}, "b @ sha")
+	assert.NoError(t, err)
+
+	err = sink.commitAndPush(t.Context(), gitRepo, dir, map[string][]byte{"a.json": []byte("{}\n")}, "a @ sha", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sink.metrics.gitPushFailures))
+
+	for _, name := range []string{"a.json", "b.json"} {
+		contents, err := testGitSink(bare).read(t.Context(), name)
+		assert.NoError(t, err)
+		assert.Equal(t, "{}\n", string(contents))
+	}
+}
+
+func TestGitSinkPushPermanentError(t *testing.T) {
+	origin, _ := testOriginRepo(t, map[string]string{"README.md": ""})
+	bare := t.TempDir()
+	_, err := git.PlainClone(bare, true, &git.CloneOptions{URL: origin})
+	assert.NoError(t, err)
+
+	sink := testGitSink(bare)
+	sink.retryDelay = time.Millisecond
+	dir := t.TempDir()
+	gitRepo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: bare})
+	assert.NoError(t, err)
+
+	// pushing again won't help when the repository is gone
+	assert.NoError(t, os.RemoveAll(bare))
+
+	err = sink.commitAndPush(t.Context(), gitRepo, dir, map[string][]byte{"a.json": []byte("{}\n")}, "a @ sha", nil)
+	assert.ErrorIs(t, err, transport.ErrRepositoryNotFound)
+	assert.NotContains(t, err.Error(), "attempts")
+	assert.Equal(t, 1.0, testutil.ToFloat64(sink.metrics.gitPushFailures))
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// maximum nesting of submodules, the same limit go-git uses for recursive clones
+const maxSubmoduleDepth = 10
+
+const fileProtocol = "file"
+
+// returns the credentials for cloning a git URL
+type authFunc func(url string) (transport.AuthMethod, error)
+
+// a submodule as recorded in the tree of its parent commit
+type gitlink struct {
+	path string
+	sha  plumbing.Hash
+}
+
+// checks out the submodules of commit into the worktree at dir recursively. Each submodule is checked out
+// from the cached repository of its URL, so a submodule shared by several repos is only fetched once per
+// run. Submodules outside of the sparse checkout of r are skipped
+func (c *cloneCache) checkoutSubmodules(ctx context.Context, r Repo, dir string, commit *object.Commit, authFor authFunc, logger *slog.Logger) ([]Submodule, error) {
+	var sparseDirs []string
+	if r.SparseCheckout {
+		cached, err := c.open(r.URL)
+		if err != nil {
+			return nil, err
+		}
+		sparseDirs, err = sparseCheckoutDirs(cached.repo, commit.Hash, r.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.checkoutNestedSubmodules(ctx, dir, "", r.URL, commit, sparseDirs, authFor, logger, 1)
+}
+
+// checks out the submodules of commit, which was checked out from url into dir, prefix is the path of dir
+// relative to the root of the repo
+func (c *cloneCache) checkoutNestedSubmodules(ctx context.Context, dir string, prefix string, url string, commit *object.Commit, sparseDirs []string, authFor authFunc, logger *slog.Logger, depth int) ([]Submodule, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	gitlinks, err := treeGitlinks(tree)
+	if err != nil || len(gitlinks) == 0 {
+		return nil, err
+	}
+	if depth > maxSubmoduleDepth {
+		return nil, fmt.Errorf("submodules are nested more than %d levels deep", maxSubmoduleDepth)
+	}
+	modules, err := readGitmodules(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var submodules []Submodule
+	for _, link := range gitlinks {
+		if !inSparseCheckout(sparseDirs, link.path) {
+			continue
+		}
+		subPath := prefix + link.path
+		module, ok := modules[link.path]
+		if !ok || module.URL == "" {
+			return nil, fmt.Errorf("submodule '%s' has no URL in .gitmodules", subPath)
+		}
+		subURL, err := submoduleURL(url, module.URL)
+		if err != nil {
+			return nil, fmt.Errorf("submodule '%s': %w", subPath, err)
+		}
+		auth, err := authFor(subURL)
+		if err != nil {
+			return nil, fmt.Errorf("submodule '%s': %w", subPath, err)
+		}
+
+		subLogger := logger.With("submodule", subPath)
+		subDir := filepath.Join(dir, filepath.FromSlash(link.path))
+		// the checkout of the parent creates an empty directory for the submodule unless it's sparse
+		err = os.MkdirAll(subDir, FolderPerm)
+		if err != nil {
+			return nil, err
+		}
+		subCommit, err := c.checkout(ctx, Repo{URL: subURL, Ref: link.sha.String()}, subDir, auth, subLogger)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check out submodule '%s': %w", subPath, err)
+		}
+		subLogger.Info("Checked out submodule", "url", subURL, "sha", link.sha.String())
+		submodules = append(submodules, Submodule{Path: subPath, URL: subURL, SHA: link.sha.String()})
+
+		nested, err := c.checkoutNestedSubmodules(ctx, subDir, subPath+"/", subURL, subCommit, nil, authFor, logger, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		submodules = append(submodules, nested...)
+	}
+	return submodules, nil
+}
+
+// returns the submodules recorded in tree, sorted by path
+func treeGitlinks(tree *object.Tree) ([]gitlink, error) {
+	var gitlinks []gitlink
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode == filemode.Submodule {
+			gitlinks = append(gitlinks, gitlink{path: name, sha: entry.Hash})
+		}
+	}
+	slices.SortFunc(gitlinks, func(a, b gitlink) int { return strings.Compare(a.path, b.path) })
+	return gitlinks, nil
+}
+
+// returns the submodules configured in the .gitmodules file of tree by their path
+func readGitmodules(tree *object.Tree) (map[string]*config.Submodule, error) {
+	file, err := tree.File(".gitmodules")
+	if errors.Is(err, object.ErrFileNotFound) {
+		return map[string]*config.Submodule{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	modules := config.NewModules()
+	err = modules.Unmarshal([]byte(contents))
+	if err != nil {
+		return nil, fmt.Errorf("invalid .gitmodules: %w", err)
+	}
+
+	byPath := map[string]*config.Submodule{}
+	for _, module := range modules.Submodules {
+		byPath[path.Clean(module.Path)] = module
+	}
+	return byPath, nil
+}
+
+// whether the submodule at subPath is part of the sparse checkout, nil dirs check out everything
+func inSparseCheckout(dirs []string, subPath string) bool {
+	if dirs == nil {
+		return true
+	}
+	for _, dir := range dirs {
+		if strings.HasPrefix(subPath+"/", dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the URL of a submodule, a relative URL like ../other.git is relative to the URL of its parent
+// repository, e.g. https://gitlab.com/group/other.git for https://gitlab.com/group/repo.git. Submodules can't
+// use local paths unless the parent does as that would read repositories from the executor's filesystem
+func submoduleURL(parentURL string, url string) (string, error) {
+	if strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../") {
+		relative := url
+		base := strings.TrimSuffix(parentURL, "/")
+		sep := "/"
+		for {
+			if rest, ok := strings.CutPrefix(url, "./"); ok {
+				url = rest
+				continue
+			}
+			rest, ok := strings.CutPrefix(url, "../")
+			if !ok {
+				break
+			}
+			url = rest
+			// the path of scp-like URLs such as git@gitlab.com:group/repo.git starts after the colon
+			i := strings.LastIndexAny(base, "/:")
+			if i < 0 {
+				return "", fmt.Errorf("relative URL '%s' is outside of '%s'", relative, parentURL)
+			}
+			sep, base = base[i:i+1], base[:i]
+		}
+		url = base + sep + url
+	}
+
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL '%s': %w", url, err)
+	}
+	parent, err := transport.NewEndpoint(parentURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL '%s': %w", parentURL, err)
+	}
+	if ep.Protocol == fileProtocol && parent.Protocol != fileProtocol {
+		return "", fmt.Errorf("local URL '%s' is not allowed", url)
+	}
+	return url, nil
+}
+
+// returns the submodule that contains dir, if any
+func submoduleContaining(tree *object.Tree, dir string) (string, bool) {
+	for p := dir; p != "." && p != "/"; p = path.Dir(p) {
+		entry, err := tree.FindEntry(p)
+		if err == nil && entry.Mode == filemode.Submodule {
+			return p, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// commits the given files and submodules, which are recorded by path and commit, to the repository at dir
+func testSubmoduleCommit(t *testing.T, dir string, files map[string]string, submodules map[string]plumbing.Hash) plumbing.Hash {
+	t.Helper()
+	repo, err := git.PlainOpen(dir)
+	assert.NoError(t, err)
+	testCommit(t, dir, files)
+
+	idx, err := repo.Storer.Index()
+	assert.NoError(t, err)
+	for name, sha := range submodules {
+		idx.Entries = append(idx.Entries, &index.Entry{Name: name, Hash: sha, Mode: filemode.Submodule})
+	}
+	assert.NoError(t, repo.Storer.SetIndex(idx))
+
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	hash, err := wt.Commit("submodules", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+	})
+	assert.NoError(t, err)
+	return hash
+}
+
+func TestCheckoutSubmodules(t *testing.T) {
+	nested, nestedSHA := testOriginRepo(t, map[string]string{"nested.tf": ""})
+	shared, _ := testOriginRepo(t, map[string]string{"modules/vpc/main.tf": ""})
+	sharedSHA := testSubmoduleCommit(t, shared, map[string]string{
+		".gitmodules": "[submodule \"nested\"]\n\tpath = nested\n\turl = " + nested + "\n",
+	}, map[string]plumbing.Hash{"nested": nestedSHA})
+	other, otherSHA := testOriginRepo(t, map[string]string{"other.tf": ""})
+
+	origin, _ := testOriginRepo(t, map[string]string{
+		"infra/main.tf": "module \"vpc\" {\n  source = \"../vendor/shared/modules/vpc\"\n}\n",
+	})
+	testSubmoduleCommit(t, origin, map[string]string{
+		".gitmodules": "[submodule \"shared\"]\n\tpath = vendor/shared\n\turl = ../" + filepath.Base(shared) + "\n" +
+			"[submodule \"other\"]\n\tpath = other\n\turl = " + other + "\n",
+	}, map[string]plumbing.Hash{"vendor/shared": sharedSHA, "other": otherSHA})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var authURLs []string
+	authFor := func(url string) (transport.AuthMethod, error) {
+		authURLs = append(authURLs, url)
+		return nil, nil
+	}
+
+	t.Run("recursive", func(t *testing.T) {
+		authURLs = nil
+		c := testCloneCache(t)
+		repo := Repo{Name: "a", URL: origin, Ref: "master"}
+		dir := filepath.Join(t.TempDir(), "a")
+		commit, err := c.cloneRepo(t.Context(), repo, dir, nil, logger)
+		assert.NoError(t, err)
+
+		submodules, err := c.checkoutSubmodules(t.Context(), repo, dir, commit, authFor, logger)
+		assert.NoError(t, err)
+		assert.Equal(t, []Submodule{
+			{Path: "other", URL: other, SHA: otherSHA.String()},
+			{Path: "vendor/shared", URL: filepath.Join(filepath.Dir(origin), filepath.Base(shared)), SHA: sharedSHA.String()},
+			{Path: "vendor/shared/nested", URL: nested, SHA: nestedSHA.String()},
+		}, submodules)
+		assert.Equal(t, []string{other, shared, nested}, authURLs)
+		assert.FileExists(t, filepath.Join(dir, "other", "other.tf"))
+		assert.FileExists(t, filepath.Join(dir, "vendor", "shared", "modules", "vpc", "main.tf"))
+		assert.FileExists(t, filepath.Join(dir, "vendor", "shared", "nested", "nested.tf"))
+	})
+
+	t.Run("sparse checkout", func(t *testing.T) {
+		c := testCloneCache(t)
+		repo := Repo{Name: "a", URL: origin, Ref: "master", Path: "infra", SparseCheckout: true}
+		dir := filepath.Join(t.TempDir(), "a")
+		commit, err := c.cloneRepo(t.Context(), repo, dir, nil, logger)
+		assert.NoError(t, err)
+
+		submodules, err := c.checkoutSubmodules(t.Context(), repo, dir, commit, authFor, logger)
+		assert.NoError(t, err)
+		assert.Len(t, submodules, 2)
+		assert.FileExists(t, filepath.Join(dir, "vendor", "shared", "modules", "vpc", "main.tf"))
+		assert.NoDirExists(t, filepath.Join(dir, "other"))
+	})
+
+	t.Run("missing url", func(t *testing.T) {
+		broken, _ := testOriginRepo(t, nil)
+		testSubmoduleCommit(t, broken, nil, map[string]plumbing.Hash{"vendor/shared": sharedSHA})
+		c := testCloneCache(t)
+		repo := Repo{Name: "a", URL: broken, Ref: "master"}
+		dir := filepath.Join(t.TempDir(), "a")
+		commit, err := c.cloneRepo(t.Context(), repo, dir, nil, logger)
+		assert.NoError(t, err)
+
+		_, err = c.checkoutSubmodules(t.Context(), repo, dir, commit, authFor, logger)
+		assert.EqualError(t, err, "submodule 'vendor/shared' has no URL in .gitmodules")
+	})
+}
+
+func TestSubmoduleURL(t *testing.T) {
+	testCases := []struct {
+		parent string
+		url    string
+		want   string
+		err    string
+	}{
+		{parent: "https://gitlab.com/group/repo.git", url: "https://github.com/org/other.git", want: "https://github.com/org/other.git"},
+		{parent: "https://gitlab.com/group/repo.git", url: "../other.git", want: "https://gitlab.com/group/other.git"},
+		{parent: "https://gitlab.com/group/repo", url: "../../shared/other.git", want: "https://gitlab.com/shared/other.git"},
+		{parent: "https://gitlab.com/group/repo.git", url: "./sub.git", want: "https://gitlab.com/group/repo.git/sub.git"},
+		{parent: "git@gitlab.com:group/repo.git", url: "../other.git", want: "git@gitlab.com:group/other.git"},
+		{parent: "git@gitlab.com:repo.git", url: "../other.git", want: "git@gitlab.com:other.git"},
+		{parent: "https://gitlab.com/group/repo.git", url: "/etc/repo", err: "local URL '/etc/repo' is not allowed"},
+		{parent: "https://gitlab.com/group/repo.git", url: "file:///etc/repo", err: "local URL 'file:///etc/repo' is not allowed"},
+		{parent: "repo", url: "../../other.git", err: "relative URL '../../other.git' is outside of 'repo'"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			got, err := submoduleURL(tc.parent, tc.url)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"text/template"
+	"time"
 
 	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+	vault "github.com/hashicorp/vault/api"
 )
 
 // TfCreds is made up of AWS credentials and configuration for using an S3 backend with Terraform
@@ -60,6 +64,10 @@ func extractTfCreds(secret vaultutil.VaultKvData, repo Repo) (TfCreds, error) {
 	}, nil
 }
 
+// how long terraform is given to exit after being interrupted, e.g. when the pod receives a SIGTERM
+// or a repository exceeds its timeout, so that it can release the state lock before being killed
+const tfInterruptGracePeriod = 2 * time.Minute
+
 // terraform specific filenames
 // the "auto" vars files will automatically be loaded by the tf binary
 const (
@@ -160,18 +168,11 @@ func WriteTemplate[T TfVars | vaultutil.VaultKvData | TfCreds | StateVars](input
 	return nil
 }
 
-// checks the generated terraform plan file to ensure that the fips endpoint is enabled in the AWS provider configuration
-func (e *Executor) fipsComplianceCheck(repo Repo, planFile string, tf *tfexec.Terraform) error {
-	out, err := tf.ShowPlanFile(context.Background(), planFile)
-
-	if err != nil {
-		log.Println("Unable to determine FIPS compatibility")
-		return err
-	}
-
+// checks the generated terraform plan to ensure that the fips endpoint is enabled in the AWS provider configuration
+func (e *Executor) fipsComplianceCheck(repo Repo, plan *tfjson.Plan) error {
 	compliant := false
 
-	for _, provider := range out.Config.ProviderConfigs {
+	for _, provider := range plan.Config.ProviderConfigs {
 		if provider.Name == "aws" {
 			for k, v := range provider.Expressions {
 				if k == "use_fips_endpoint" && v.ConstantValue == true {
@@ -190,38 +191,104 @@ func (e *Executor) fipsComplianceCheck(repo Repo, planFile string, tf *tfexec.Te
 
 // performs a terraform show without the `-json` flag to workaround the fact that the tfexec package
 // only supports outputting the state as JSON which exposes sensitive values
-func (e *Executor) showRaw(dir string, tfBinaryLocation string) (string, error) {
-	out, err := executeCommand(dir, tfBinaryLocation, []string{"show"})
+func (e *Executor) showRaw(ctx context.Context, dir string, tfBinaryLocation string) (string, error) {
+	out, err := executeCommand(ctx, dir, tfBinaryLocation, []string{"show"})
 	if err != nil {
 		return "", err
 	}
 	return out, nil
 }
 
-// performs a terraform plan and then apply if not running in dry run mode
-// additionally captures any tf outputs if necessary
-func (e *Executor) processTfPlan(repo Repo, dryRun bool, envVars map[string]string) (map[string]tfexec.OutputMeta, error) {
-	dir := fmt.Sprintf("%s/%s/%s", e.workdir, repo.Name, repo.Path)
+// directory within the cloned repository that terraform is run in
+func (e *Executor) tfDir(repo Repo) string {
+	return fmt.Sprintf("%s/%s", e.repoDir(repo), repo.Path)
+}
+
+// directory containing every installed version of the TF binary, e.g. /usr/bin/Terraform/1.5.7/terraform
+var tfInstallDir = "/usr/bin/Terraform"
 
-	// each repo can use a different version of the TF binary, specified in App Interface
-	tfBinaryLocation := fmt.Sprintf("/usr/bin/Terraform/%s/terraform", repo.TfVersion)
+// each repo can use a different version of the TF binary, specified in App Interface
+func tfBinary(repo Repo) string {
+	return fmt.Sprintf("%s/%s/terraform", tfInstallDir, repo.TfVersion)
+}
 
-	tf, err := tfexec.NewTerraform(dir, tfBinaryLocation)
+// creates a terraform executor for the cloned repository
+func (e *Executor) newTerraform(repo Repo) (*tfexec.Terraform, error) {
+	tf, err := tfexec.NewTerraform(e.tfDir(repo), tfBinary(repo))
 	if err != nil {
 		return nil, err
 	}
+	// terraform receives a SIGINT when ctx is cancelled and is only killed after the grace period
+	err = tf.SetWaitDelay(tfInterruptGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
 
-	log.Printf("Initializing terraform config for %s\n", repo.Name)
-	err = tf.Init(
-		context.Background(),
-		tfexec.BackendConfig(BackendFile),
+// routes terraform output line by line to logger, as other repos may be processed concurrently,
+// the returned function needs to be called once the terraform command has finished
+func logTfOutput(tf *tfexec.Terraform, logger *slog.Logger) func() {
+	stdout := newTfOutputWriter(logger, "stdout")
+	stderr := newTfOutputWriter(logger, "stderr")
+	tf.SetStdout(stdout)
+	tf.SetStderr(stderr)
+	return func() {
+		stdout.Flush()
+		stderr.Flush()
+	}
+}
+
+// initializes the backend and providers of tf, one repo at a time when the plugin cache is shared
+func (e *Executor) init(ctx context.Context, tf *tfexec.Terraform) error {
+	if e.pluginCacheDir != "" {
+		e.initMu.Lock()
+		defer e.initMu.Unlock()
+	}
+	return tf.Init(ctx, tfexec.BackendConfig(BackendFile))
+}
+
+// performs a terraform plan with its output logged and reads the saved plan. The JSON plan contains the values of
+// sensitive attributes and Vault data sources, so the output of terraform is discarded before reading it
+func (e *Executor) plan(ctx context.Context, tf *tfexec.Terraform, repo Repo, planFile string, logger *slog.Logger) (*tfjson.Plan, error) {
+	flush := logTfOutput(tf, logger)
+	logger.Info("Performing terraform plan")
+	_, err := tf.Plan(
+		ctx,
+		tfexec.Destroy(repo.Delete),
+		tfexec.Out(planFile),
+		tfexec.Parallelism(e.tfParallelism),
 	)
+	flush()
+	tf.SetStdout(io.Discard)
+	tf.SetStderr(io.Discard)
 	if err != nil {
 		return nil, err
 	}
-	tf.SetStdout(os.Stdout)
-	tf.SetStderr(os.Stderr)
 
+	plan, err := tf.ShowPlanFile(ctx, planFile)
+	if err != nil {
+		logger.Error("Unable to read generated plan file")
+		return nil, err
+	}
+	return plan, nil
+}
+
+// performs a terraform plan and then applies that plan if not running in dry run mode
+// additionally captures any tf outputs if necessary
+func (e *Executor) processTfPlan(ctx context.Context, repo Repo, vaultClient *vault.Client, dryRun bool, envVars map[string]string, logger *slog.Logger, result *RepoResult) (map[string]tfexec.OutputMeta, error) {
+	tf, err := e.newTerraform(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.phase(PhaseInit, logger, func(logger *slog.Logger) error {
+		logger.Info("Initializing terraform config")
+		return e.init(ctx, tf)
+	})
+	if err != nil {
+		return nil, err
+	}
 	var blackhole bytes.Buffer
 	// supply aws access key, secret key variables to the terraform executable for remote_backend_state
 	err = tf.SetEnv(envVars)
@@ -229,72 +296,75 @@ func (e *Executor) processTfPlan(repo Repo, dryRun bool, envVars map[string]stri
 		return nil, err
 	}
 
-	planFile := fmt.Sprintf("%s/%s-plan", e.workdir, repo.Name)
-	var output map[string]tfexec.OutputMeta
-
-	if dryRun {
-		log.Printf("Performing terraform plan for %s", repo.Name)
-		_, err = tf.Plan(
-			context.Background(),
-			tfexec.Destroy(repo.Delete),
-			tfexec.Out(planFile), // this plan file will be useful to have in a later improvement as well
-			tfexec.Parallelism(e.tfParallelism),
-		)
+	// the saved plan is what gets applied so the reported changes are exactly what is performed
+	planFile := e.planFile(repo)
+	err = result.phase(PhasePlan, logger, func(logger *slog.Logger) error {
+		plan, err := e.plan(ctx, tf, repo, planFile, logger)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	} else {
-		// tf.exec.Destroy flag cannot be passed to tf.Apply in same fashion as above Plan() logic
-		if repo.Delete {
-			log.Printf("Performing terraform destroy for %s", repo.Name)
-			err = tf.Destroy(
-				context.Background(),
-				tfexec.Parallelism(e.tfParallelism),
-			)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			log.Printf("Performing terraform apply for %s", repo.Name)
-			err = tf.Apply(
-				context.Background(),
-				tfexec.Parallelism(e.tfParallelism),
-			)
-			if err != nil {
-				return nil, err
-			}
+		result.Changes = countPlanChanges(plan)
 
-			if repo.TfVariables.Outputs.Path != "" {
-				log.Printf("Capturing Output values to save to %s in Vault", repo.TfVariables.Outputs.Path)
-				// don't log the results of `terraform output -json` as that can leak sensitive credentials
-				tf.SetStdout(&blackhole)
-				tf.SetStderr(&blackhole)
-				output, err = tf.Output(
-					context.Background(),
-				)
-				if err != nil {
-					return nil, err
-				}
-			}
+		if repo.RequireFips && dryRun {
+			return e.fipsComplianceCheck(repo, plan)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
+	if dryRun {
+		return nil, e.publishPlan(ctx, tf, repo, planFile, logger, result)
 	}
-	if !dryRun {
-		rawState, err := e.showRaw(dir, tfBinaryLocation)
-		if err != nil {
-			return nil, err
+
+	err = result.phase(PhaseApply, logger, func(logger *slog.Logger) error {
+		defer logTfOutput(tf, logger)()
+		if repo.Delete {
+			logger.Info("Performing terraform destroy")
+		} else {
+			logger.Info("Performing terraform apply")
 		}
-		err = e.commitAndPushState(repo, rawState)
+		return tf.Apply(
+			ctx,
+			tfexec.DirOrPlan(planFile),
+			tfexec.Parallelism(e.tfParallelism),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var output map[string]tfexec.OutputMeta
+	if !repo.Delete && repo.TfVariables.Outputs.Path != "" {
+		err = result.phase(PhaseOutputWrite, logger, func(logger *slog.Logger) error {
+			logger.Info("Capturing Output values to save in Vault", "path", repo.TfVariables.Outputs.Path)
+			// don't log the results of `terraform output -json` as that can leak sensitive credentials
+			tf.SetStdout(&blackhole)
+			tf.SetStderr(&blackhole)
+			output, err = tf.Output(
+				ctx,
+			)
+			return err
+		})
 		if err != nil {
-			log.Printf("Unable to commit state file to Git, error: %s", err)
+			return nil, err
 		}
 	}
 
-	if repo.RequireFips && dryRun {
-		err = e.fipsComplianceCheck(repo, planFile, tf)
+	err = result.phase(PhaseStatePush, logger, func(logger *slog.Logger) error {
+		rawState, err := e.showRaw(ctx, e.tfDir(repo), tfBinary(repo))
 		if err != nil {
-			return nil, err
+			return err
 		}
+		err = e.queueState(repo, newAppliedState(repo, result), rawState)
+		if err != nil {
+			logger.Error("Unable to render state file", "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return output, nil
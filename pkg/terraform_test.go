@@ -1,11 +1,16 @@
 package pkg
 
 import (
+	"bytes"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
+	"github.com/hashicorp/terraform-exec/tfexec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -165,3 +170,69 @@ func TestWriteTemplate(t *testing.T) {
 		assert.Equal(t, string(expected), string(output))
 	})
 }
+
+// a fake terraform binary whose saved plan contains the value of a Vault data source
+const fakeTerraformScript = `#!/bin/sh
+case "$1" in
+version)
+	echo '{"terraform_version": "1.5.7", "platform": "linux_amd64", "provider_selections": {}}'
+	;;
+init)
+	# fails if another init is using the plugin cache at the same time
+	mkdir "$TF_PLUGIN_CACHE_DIR/.lock" || exit 1
+	sleep 0.1
+	rmdir "$TF_PLUGIN_CACHE_DIR/.lock"
+	;;
+plan)
+	echo 'Plan: 0 to add, 0 to change, 0 to destroy.'
+	;;
+show)
+	echo '{"format_version": "1.2", "terraform_version": "1.5.7", "prior_state": {"format_version": "1.0", "values": {"root_module": {"resources": [{"address": "data.vault_generic_secret.creds", "mode": "data", "type": "vault_generic_secret", "name": "creds", "values": {"data": {"password": "OHNO"}}}]}}}}'
+	;;
+esac
+`
+
+func TestPlanDoesNotLogPlanJSON(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "terraform")
+	assert.NoError(t, os.WriteFile(binary, []byte(fakeTerraformScript), 0755))
+	tf, err := tfexec.NewTerraform(dir, binary)
+	assert.NoError(t, err)
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	e := &Executor{tfParallelism: 1}
+
+	plan, err := e.plan(t.Context(), tf, repoWithoutExplicitBucketSettings, filepath.Join(dir, "plan"), logger)
+	assert.NoError(t, err)
+	assert.NotNil(t, plan.PriorState)
+	assert.Contains(t, logs.String(), "Plan: 0 to add, 0 to change, 0 to destroy.")
+	assert.NotContains(t, logs.String(), "OHNO")
+}
+
+func TestInitWithSharedPluginCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("TF_PLUGIN_CACHE_DIR", cacheDir)
+	e := &Executor{pluginCacheDir: cacheDir}
+
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	for i := range errs {
+		dir := t.TempDir()
+		binary := filepath.Join(dir, "terraform")
+		assert.NoError(t, os.WriteFile(binary, []byte(fakeTerraformScript), 0755))
+		tf, err := tfexec.NewTerraform(dir, binary)
+		assert.NoError(t, err)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = e.init(t.Context(), tf)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+}
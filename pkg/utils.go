@@ -2,39 +2,53 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
+	"slices"
+	"strings"
+	"syscall"
 
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"gopkg.in/yaml.v3"
 )
 
 // FolderPerm is 0770 in chmod
 const FolderPerm = 0770
 
-func processConfig(cfgPath string) (*Input, error) {
+// LoadConfig reads and parses the config file at cfgPath
+func LoadConfig(cfgPath string) (*Input, error) {
 	raw, err := os.ReadFile(cfgPath)
 	if err != nil {
 		return nil, err
 	}
+	return ParseInput(raw)
+}
 
+// ParseInput parses a YAML or JSON config in the format generated by Qontract Reconcile.
+// Unknown keys are rejected so that a misspelled setting doesn't silently fall back to its default
+func ParseInput(raw []byte) (*Input, error) {
 	var cfg Input
-	// internally yaml.Unmarshal will use json.Unmarshal if it detects json format
-	err = yaml.Unmarshal(raw, &cfg)
-	if err != nil {
+	// JSON is a subset of YAML so the YAML decoder handles both formats
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	err := dec.Decode(&cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, err
 	}
 	return &cfg, nil
 }
 
 // generic function for executing commands on host
-func executeCommand(dir, command string, args []string) (string, error) {
-	cmd := exec.Command(command, args...)
+// when ctx is cancelled the command is interrupted and given tfInterruptGracePeriod to exit before being killed
+func executeCommand(ctx context.Context, dir, command string, args []string) (string, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGINT)
+	}
+	cmd.WaitDelay = tfInterruptGracePeriod
 	cmd.Dir = dir
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -47,42 +61,36 @@ func executeCommand(dir, command string, args []string) (string, error) {
 	return stdout.String(), nil
 }
 
-func (r Repo) cloneRepo(workdir string, gitlabUsername string, gitlabToken string) error {
-	// go-git doesn't create a new directory in the cloned dir so we have to create one ourselves
-	clonedDir := fmt.Sprintf("%s/%s", workdir, r.Name)
-	err := os.Mkdir(clonedDir, FolderPerm)
-	if err != nil {
-		return err
-	}
-
-	repo, err := git.PlainClone(clonedDir, false, &git.CloneOptions{
-		URL: r.URL,
-		Auth: &http.BasicAuth{
-			Username: gitlabUsername,
-			Password: gitlabToken,
-		},
-	})
-	if err != nil {
-		return err
-	}
-
-	wt, err := repo.Worktree()
-	if err != nil {
-		return err
-	}
-
-	err = wt.Checkout(&git.CheckoutOptions{
-		Hash: plumbing.NewHash(r.Ref),
-	})
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 // MaskSensitiveStateValues redacts any Vault secrets in a Terraform human-readable state file
 // more specifically, any Terraform datasource beginning with `vault_` will be redacted from the output
 func MaskSensitiveStateValues(src string) string {
 	re := regexp.MustCompile(`(?sU)(data "vault_.+\n})`)
 	return re.ReplaceAllString(src, "[REDACTED VAULT SECRET]")
 }
+
+// matches the first line of a Vault data source in a human-readable plan, e.g. ` <= data "vault_generic_secret" "foo" {`
+var planVaultDataRegexp = regexp.MustCompile(`^(.*)data "vault_[^"]*" "[^"]*" \{$`)
+
+// MaskSensitivePlanValues redacts any Vault secrets in a Terraform human-readable plan like MaskSensitiveStateValues
+// does for state. The blocks of plans are indented and prefixed with their action, so a block ends with the first
+// closing brace indented as far as the `data` keyword
+func MaskSensitivePlanValues(src string) string {
+	lines := strings.Split(src, "\n")
+	masked := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		m := planVaultDataRegexp.FindStringSubmatch(lines[i])
+		if m == nil {
+			masked = append(masked, lines[i])
+			continue
+		}
+		indent := strings.Repeat(" ", len(m[1]))
+		end := slices.Index(lines[i:], indent+"}")
+		if end < 0 {
+			// an incomplete block is masked up to the end
+			end = len(lines) - i - 1
+		}
+		masked = append(masked, indent+"[REDACTED VAULT SECRET]")
+		i += end
+	}
+	return strings.Join(masked, "\n")
+}
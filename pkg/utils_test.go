@@ -3,6 +3,7 @@ package pkg
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
@@ -43,7 +44,7 @@ func TestProcessConfig(t *testing.T) {
 		os.WriteFile(cfgPath, []byte(dedent.Dedent(raw)), 0644)
 		defer os.Remove(cfgPath)
 
-		cfg, err := processConfig(cfgPath)
+		cfg, err := LoadConfig(cfgPath)
 		assert.Nil(t, err)
 
 		expected := Input{
@@ -122,7 +123,7 @@ func TestProcessConfig(t *testing.T) {
 		os.WriteFile(cfgPath, []byte(dedent.Dedent(raw)), 0644)
 		defer os.Remove(cfgPath)
 
-		cfg, err := processConfig(cfgPath)
+		cfg, err := LoadConfig(cfgPath)
 		assert.Nil(t, err)
 
 		expected := Input{
@@ -183,11 +184,34 @@ func TestProcessConfig(t *testing.T) {
 		os.WriteFile(cfgPath, []byte(dedent.Dedent(raw)), 0644)
 		defer os.Remove(cfgPath)
 
-		_, err := processConfig(cfgPath)
+		_, err := LoadConfig(cfgPath)
 		if err == nil {
 			t.Fatal(fmt.Errorf("Invalid payload should result in error"))
 		}
 	})
+
+	t.Run("unknown keys return error", func(t *testing.T) {
+		raw := `
+            dry_run: true
+            repos:
+            - repository: https://gitlab.myinstance.com/some-gl-group/project_a
+              name: foo-foo
+              ref: d82b3cb292d91ec2eb26fc282d751555088819f3
+              tf_version: 1.5.7
+              requires_fips: true
+		`
+
+		_, err := ParseInput([]byte(dedent.Dedent(raw)))
+
+		assert.ErrorContains(t, err, "field requires_fips not found in type pkg.Repo")
+	})
+
+	t.Run("empty config returns no repos", func(t *testing.T) {
+		cfg, err := ParseInput(nil)
+
+		assert.Nil(t, err)
+		assert.Empty(t, cfg.Repos)
+	})
 }
 
 func TestMaskingOfVaultValues(t *testing.T) {
@@ -260,4 +284,50 @@ func TestMaskingOfVaultValues(t *testing.T) {
 		assert.Equal(t, dedent.Dedent(expected), actual)
 	})
 
+	t.Run("plan values are masked correctly", func(t *testing.T) {
+		input := strings.Join([]string{
+			"Terraform will perform the following actions:",
+			"",
+			"  # data.vault_generic_secret.bigsecret will be read during apply",
+			"  # (depends on a resource or a module with changes pending)",
+			" <= data \"vault_generic_secret\" \"bigsecret\" {",
+			"      + data      = (sensitive value)",
+			"      + data_json = jsonencode(",
+			"            {",
+			"              + fake_sensitive_cred = \"OHNO\"",
+			"            }",
+			"        )",
+			"      + path      = \"terraform-repo/input/athena/sensitivesecret\"",
+			"    }",
+			"",
+			"  # aws_athena_database.vault will be created",
+			"  + resource \"aws_athena_database\" \"vault\" {",
+			"      + name = \"app_sre_vault\"",
+			"    }",
+			"",
+			"Plan: 1 to add, 0 to change, 0 to destroy.",
+		}, "\n")
+
+		expected := strings.Join([]string{
+			"Terraform will perform the following actions:",
+			"",
+			"  # data.vault_generic_secret.bigsecret will be read during apply",
+			"  # (depends on a resource or a module with changes pending)",
+			"    [REDACTED VAULT SECRET]",
+			"",
+			"  # aws_athena_database.vault will be created",
+			"  + resource \"aws_athena_database\" \"vault\" {",
+			"      + name = \"app_sre_vault\"",
+			"    }",
+			"",
+			"Plan: 1 to add, 0 to change, 0 to destroy.",
+		}, "\n")
+
+		assert.Equal(t, expected, MaskSensitivePlanValues(input))
+	})
+
+	t.Run("incomplete plan blocks are masked to the end", func(t *testing.T) {
+		input := " <= data \"vault_generic_secret\" \"bigsecret\" {\n      + data = \"OHNO\""
+		assert.Equal(t, "    [REDACTED VAULT SECRET]", MaskSensitivePlanValues(input))
+	})
 }
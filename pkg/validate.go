@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
+)
+
+// ValidateInput checks every repo of a config for problems that would otherwise only surface once the repo
+// is being processed, e.g. an empty ref turning into a zero hash or a name escaping the workdir.
+// All problems are reported at once rather than just the first one
+func ValidateInput(cfg *Input) error {
+	var errs []error
+	names := make(map[string]int, len(cfg.Repos))
+	for _, repo := range cfg.Repos {
+		names[repo.Name]++
+	}
+
+	for i, repo := range cfg.Repos {
+		id := repo.Name
+		if id == "" {
+			id = fmt.Sprintf("#%d", i+1)
+		}
+		for _, err := range validateRepo(repo) {
+			errs = append(errs, fmt.Errorf("repository '%s': %w", id, err))
+		}
+		if repo.Name != "" && names[repo.Name] > 1 {
+			errs = append(errs, fmt.Errorf("repository '%s': name is used by %d repositories", id, names[repo.Name]))
+			// only report a duplicate once
+			names[repo.Name] = 0
+		}
+	}
+
+	_, err := buildDepGraph(cfg.Repos)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	mr := cfg.MergeRequest
+	if mr != (MergeRequest{}) && (mr.Project == "" || mr.IID <= 0) {
+		errs = append(errs, errors.New("merge_request requires a project and a positive iid"))
+	}
+	switch cfg.PublishPlans {
+	case "", PublishPlansStateSink:
+	case PublishPlansMergeRequest:
+		if mr == (MergeRequest{}) {
+			errs = append(errs, errors.New("publish_plans: merge_request requires merge_request"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("publish_plans '%s' must be '%s' or '%s'", cfg.PublishPlans, PublishPlansStateSink, PublishPlansMergeRequest))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config, %d problem(s) found:\n%w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// returns every problem with a single repo
+func validateRepo(repo Repo) []error {
+	var errs []error
+
+	switch {
+	case repo.Name == "":
+		errs = append(errs, errors.New("name is required"))
+	case repo.Name == "." || repo.Name == ".." || strings.ContainsAny(repo.Name, `/\`):
+		errs = append(errs, fmt.Errorf("name '%s' must not be '.', '..' or contain path separators", repo.Name))
+	}
+
+	if repo.URL == "" {
+		errs = append(errs, errors.New("repository is required"))
+	}
+
+	if repo.Ref == "" {
+		errs = append(errs, errors.New("ref is required"))
+	} else if err := validateRefName(repo.Ref); err != nil {
+		errs = append(errs, err)
+	}
+
+	if repo.ProtectedBranch != "" {
+		if err := ValidateBranchName(repo.ProtectedBranch); err != nil {
+			errs = append(errs, fmt.Errorf("protected_branch: %w", err))
+		}
+	}
+
+	// an empty project path refers to the root of the repository
+	if repo.Path != "" && !filepath.IsLocal(repo.Path) {
+		errs = append(errs, fmt.Errorf("project_path '%s' must be a relative path within the repository", repo.Path))
+	}
+
+	if repo.TfVersion == "" {
+		errs = append(errs, errors.New("tf_version is required"))
+	} else if strings.ContainsAny(repo.TfVersion, `/\`) {
+		errs = append(errs, fmt.Errorf("tf_version '%s' must not contain path separators", repo.TfVersion))
+	} else if _, err := os.Stat(tfBinary(repo)); err != nil {
+		errs = append(errs, fmt.Errorf("terraform version '%s' is not installed, %s does not exist", repo.TfVersion, tfBinary(repo)))
+	}
+
+	if (repo.Bucket == "") != (repo.Region == "") {
+		errs = append(errs, errors.New("bucket and region must either both be set or both be omitted"))
+	}
+
+	if err := vaultutil.ValidatePath(repo.AWSCreds.Path); err != nil {
+		errs = append(errs, fmt.Errorf("aws_creds: %w", err))
+	}
+	if repo.TfVariables.Inputs.Path != "" {
+		if err := vaultutil.ValidatePath(repo.TfVariables.Inputs.Path); err != nil {
+			errs = append(errs, fmt.Errorf("variables.inputs: %w", err))
+		}
+	}
+	if repo.TfVariables.Outputs.Path != "" {
+		if err := vaultutil.ValidatePath(repo.TfVariables.Outputs.Path); err != nil {
+			errs = append(errs, fmt.Errorf("variables.outputs: %w", err))
+		}
+	}
+
+	if repo.SSHKey.Path != "" {
+		if err := vaultutil.ValidatePath(repo.SSHKey.Path); err != nil {
+			errs = append(errs, fmt.Errorf("ssh_key: %w", err))
+		}
+	}
+
+	// the default is irrelevant as only a timeout set for the repo can be invalid
+	if _, err := repo.timeout(0); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/app-sre/terraform-repo-executor/pkg/vaultutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// installs a fake terraform binary for each of the supplied versions
+func fakeTfInstallDir(t *testing.T, versions ...string) {
+	dir := t.TempDir()
+	for _, version := range versions {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, version), FolderPerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, version, "terraform"), nil, 0755))
+	}
+
+	previous := tfInstallDir
+	tfInstallDir = dir
+	t.Cleanup(func() {
+		tfInstallDir = previous
+	})
+}
+
+func TestValidateInput(t *testing.T) {
+	fakeTfInstallDir(t, tfVersion)
+
+	t.Run("valid config passes", func(t *testing.T) {
+		withInputs := repoWithoutExplicitBucketSettings
+		withInputs.Name = "b-repo"
+		withInputs.Bucket = bucket
+		withInputs.Region = region
+		withInputs.DependsOn = []string{repoName}
+		withInputs.TfVariables.Inputs = vaultutil.VaultSecret{Path: "terraform/inputs/b-repo"}
+
+		err := ValidateInput(&Input{Repos: []Repo{repoWithoutExplicitBucketSettings, withInputs}})
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		escaping := repoWithoutExplicitBucketSettings
+		escaping.Name = "../escape"
+		escaping.Path = "../../etc"
+		escaping.Ref = ""
+		escaping.TfVersion = ""
+
+		misconfigured := repoWithoutExplicitBucketSettings
+		misconfigured.Name = "b-repo"
+		misconfigured.TfVersion = "0.11.0"
+		misconfigured.Bucket = bucket
+		misconfigured.AWSCreds.Path = "no-mount"
+		misconfigured.TfVariables.Outputs = vaultutil.VaultSecret{Path: "/outputs"}
+		misconfigured.Timeout = "forever"
+		misconfigured.DependsOn = []string{"c-repo"}
+
+		err := ValidateInput(&Input{Repos: []Repo{
+			repoWithoutExplicitBucketSettings,
+			repoWithoutExplicitBucketSettings,
+			escaping,
+			misconfigured,
+		}})
+
+		expected := fmt.Sprintf(`invalid config, 11 problem(s) found:
+repository 'a-repo': name is used by 2 repositories
+repository '../escape': name '../escape' must not be '.', '..' or contain path separators
+repository '../escape': ref is required
+repository '../escape': project_path '../../etc' must be a relative path within the repository
+repository '../escape': tf_version is required
+repository 'b-repo': terraform version '0.11.0' is not installed, %s/0.11.0/terraform does not exist
+repository 'b-repo': bucket and region must either both be set or both be omitted
+repository 'b-repo': aws_creds: invalid vault path: no-mount
+repository 'b-repo': variables.outputs: invalid vault path: /outputs
+repository 'b-repo': invalid timeout 'forever', expected a positive duration such as '45m'
+repository 'b-repo' depends on unknown repository 'c-repo'`, tfInstallDir)
+		assert.EqualError(t, err, expected)
+	})
+
+	t.Run("repos without a name are identified by their position", func(t *testing.T) {
+		unnamed := repoWithoutExplicitBucketSettings
+		unnamed.Name = ""
+
+		err := ValidateInput(&Input{Repos: []Repo{repoWithoutExplicitBucketSettings, unnamed}})
+
+		assert.EqualError(t, err, "invalid config, 1 problem(s) found:\nrepository '#2': name is required")
+	})
+
+	t.Run("plans are published to a known destination and merge request", func(t *testing.T) {
+		testCases := []struct {
+			input Input
+			err   string
+		}{
+			{input: Input{PublishPlans: PublishPlansStateSink}},
+			{input: Input{PublishPlans: PublishPlansMergeRequest, MergeRequest: MergeRequest{Project: "service/app-interface", IID: 42}}},
+			{input: Input{PublishPlans: PublishPlansMergeRequest}, err: "publish_plans: merge_request requires merge_request"},
+			{input: Input{MergeRequest: MergeRequest{Project: "service/app-interface"}}, err: "merge_request requires a project and a positive iid"},
+			{input: Input{PublishPlans: "slack"}, err: "publish_plans 'slack' must be 'state_sink' or 'merge_request'"},
+		}
+		for _, tc := range testCases {
+			tc.input.Repos = []Repo{repoWithoutExplicitBucketSettings}
+			err := ValidateInput(&tc.input)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, "invalid config, 1 problem(s) found:\n"+tc.err)
+			}
+		}
+	})
+}
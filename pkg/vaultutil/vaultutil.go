@@ -5,7 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/hashicorp/terraform-exec/tfexec"
@@ -14,7 +14,7 @@ import (
 
 // VaultSecret contains information on where to find a secret in Vault
 type VaultSecret struct {
-	Path    string `yaml:"path" json:"path"`
+	Path    string `yaml:"path" json:"path" jsonschema:"required"`
 	Version int    `yaml:"version" json:"version"`
 }
 
@@ -29,8 +29,8 @@ const (
 
 // GetMountVersions retrieves the KV engine version of each mount in Vault as a map
 // and ignores any non KV mounts
-func GetMountVersions(client *vault.Client) (map[string]string, error) {
-	mounts, err := client.Sys().ListMounts()
+func GetMountVersions(ctx context.Context, client *vault.Client) (map[string]string, error) {
+	mounts, err := client.Sys().ListMountsWithContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +47,7 @@ func GetMountVersions(client *vault.Client) (map[string]string, error) {
 }
 
 // InitVaultClient sets up a Vault client that logs in using AppRole credentials
-func InitVaultClient(addr, roleID, secretID string) (*vault.Client, error) {
+func InitVaultClient(ctx context.Context, addr, roleID, secretID string) (*vault.Client, error) {
 	cfg := &vault.Config{
 		Address: addr,
 	}
@@ -61,7 +61,7 @@ func InitVaultClient(addr, roleID, secretID string) (*vault.Client, error) {
 		"role_id":   roleID,
 		"secret_id": secretID,
 	}
-	secret, err := client.Logical().Write("auth/approle/login", data)
+	secret, err := client.Logical().WriteWithContext(ctx, "auth/approle/login", data)
 	if err != nil {
 		return nil, err
 	}
@@ -75,8 +75,8 @@ func InitVaultClient(addr, roleID, secretID string) (*vault.Client, error) {
 }
 
 // WriteOutputs takes any output values from a Terraform apply and then writes them into Vault
-func WriteOutputs(client *vault.Client, secretInfo VaultSecret, data map[string]tfexec.OutputMeta, mountVersions map[string]string) error {
-	log.Printf("Writing Output values from Terraform Apply to %s in Vault", secretInfo.Path)
+func WriteOutputs(ctx context.Context, logger *slog.Logger, client *vault.Client, secretInfo VaultSecret, data map[string]tfexec.OutputMeta, mountVersions map[string]string) error {
+	logger.Info("Writing Output values from Terraform Apply to Vault", "path", secretInfo.Path)
 	secretData := make(VaultKvData)
 
 	for k, v := range data {
@@ -88,7 +88,7 @@ func WriteOutputs(client *vault.Client, secretInfo VaultSecret, data map[string]
 		secretData[k] = value
 	}
 
-	err := WriteVaultSecret(client, secretInfo, secretData, mountVersions)
+	err := WriteVaultSecret(ctx, client, secretInfo, secretData, mountVersions)
 	if err != nil {
 		return err
 	}
@@ -117,73 +117,102 @@ func splitVaultPath(path string) (string, string, error) {
 	return before, after, nil
 }
 
+// ValidatePath checks that a secret path consists of a mount and a path within that mount
+func ValidatePath(path string) error {
+	mount, secretPath, err := splitVaultPath(path)
+	if err != nil {
+		return err
+	}
+	if mount == "" || secretPath == "" {
+		return fmt.Errorf("invalid vault path: %s", path)
+	}
+	return nil
+}
+
 // WriteVaultSecret writes a map of KV pairs to Vault at the specified path
-func WriteVaultSecret(client *vault.Client, secretInfo VaultSecret, data map[string]interface{}, mountVersions map[string]string) error {
+func WriteVaultSecret(ctx context.Context, client *vault.Client, secretInfo VaultSecret, data map[string]interface{}, mountVersions map[string]string) error {
 	mount, path, err := splitVaultPath(secretInfo.Path)
 	if err != nil {
 		return err
 	}
 	if mountVersions[mount] == KvV2 {
-		_, err = client.KVv2(mount).Put(context.Background(), path, data)
+		_, err = client.KVv2(mount).Put(ctx, path, data)
 		return err
 	}
-	return client.KVv1(mount).Put(context.Background(), path, data)
+	return client.KVv1(mount).Put(ctx, path, data)
 }
 
 // GetVaultTfSecret retrieves the contents of a secret in Vault
-func GetVaultTfSecret(client *vault.Client, secretInfo VaultSecret, mountVersions map[string]string) (VaultKvData, error) {
+func GetVaultTfSecret(ctx context.Context, client *vault.Client, secretInfo VaultSecret, mountVersions map[string]string) (VaultKvData, error) {
+	secret, _, err := GetVaultTfSecretVersion(ctx, client, secretInfo, mountVersions)
+	return secret, err
+}
+
+// GetVaultTfSecretVersion retrieves the contents of a secret in Vault along with the version that was read,
+// which resolves the latest version of a KV2 secret. The version is 0 for KV1 secrets as they aren't versioned
+func GetVaultTfSecretVersion(ctx context.Context, client *vault.Client, secretInfo VaultSecret, mountVersions map[string]string) (VaultKvData, int, error) {
 	var secret VaultKvData
+	var version int
 
 	mount, _, err := splitVaultPath(secretInfo.Path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	switch mountVersions[mount] {
 	case KvV1:
-		rawSecret, err := client.Logical().Read(secretInfo.Path)
+		rawSecret, err := client.Logical().ReadWithContext(ctx, secretInfo.Path)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		if rawSecret == nil {
-			return nil, fmt.Errorf("no secret found at specified path: %s", secretInfo.Path)
+			return nil, 0, fmt.Errorf("no secret found at specified path: %s", secretInfo.Path)
 		}
 		if len(rawSecret.Data) == 0 {
-			return nil, fmt.Errorf("no key-values stored within secret at path: %s", secretInfo.Path)
+			return nil, 0, fmt.Errorf("no key-values stored within secret at path: %s", secretInfo.Path)
 		}
 		secret = rawSecret.Data
 	case KvV2:
 		path, err := convertPathKvV2(secretInfo.Path)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		// version is optional in config yaml
 		// default behavior when omitted will be to use latest
 		var rawSecret *vault.Secret
 		if secretInfo.Version != 0 {
-			rawSecret, err = client.Logical().ReadWithData(path, map[string][]string{
+			rawSecret, err = client.Logical().ReadWithDataWithContext(ctx, path, map[string][]string{
 				"version": {fmt.Sprintf("%d", secretInfo.Version)},
 			})
 		} else {
-			rawSecret, err = client.Logical().Read(path)
+			rawSecret, err = client.Logical().ReadWithContext(ctx, path)
 		}
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		if rawSecret == nil {
-			return nil, fmt.Errorf("no secret found at specified path: %s", secretInfo.Path)
+			return nil, 0, fmt.Errorf("no secret found at specified path: %s", secretInfo.Path)
 		}
 		if len(rawSecret.Data) == 0 {
-			return nil, fmt.Errorf("no key-values stored within secret at path: %s", secretInfo.Path)
+			return nil, 0, fmt.Errorf("no key-values stored within secret at path: %s", secretInfo.Path)
 		}
 		var ok bool
 		secret, ok = rawSecret.Data["data"].(map[string]interface{})
 		if !ok {
-			return nil, fmt.Errorf("failed to process data for secret at path: %s", secretInfo.Path)
+			return nil, 0, fmt.Errorf("failed to process data for secret at path: %s", secretInfo.Path)
+		}
+		version = secretInfo.Version
+		if metadata, ok := rawSecret.Data["metadata"].(map[string]interface{}); ok {
+			if v, ok := metadata["version"].(json.Number); ok {
+				n, err := v.Int64()
+				if err == nil {
+					version = int(n)
+				}
+			}
 		}
 	default:
-		return nil, fmt.Errorf("invalid vault kv engine version specified at mount: %s", mount)
+		return nil, 0, fmt.Errorf("invalid vault kv engine version specified at mount: %s", mount)
 	}
 
-	return secret, nil
+	return secret, version, nil
 }
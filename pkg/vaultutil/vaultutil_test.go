@@ -1,9 +1,11 @@
 package vaultutil
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -28,7 +30,7 @@ func TestInitVaultClient(t *testing.T) {
 
 	roleID := "foo"
 	secretID := "bar"
-	client, err := InitVaultClient(vaultMock.URL, roleID, secretID)
+	client, err := InitVaultClient(context.Background(), vaultMock.URL, roleID, secretID)
 	assert.Nil(t, err)
 	assert.Equal(t, mockedToken, client.Token())
 }
@@ -61,7 +63,7 @@ func TestGetVaultTfSecretV2(t *testing.T) {
 		Address: vaultMock.URL,
 	})
 
-	actual, err := GetVaultTfSecret(client, VaultSecret{
+	actual, err := GetVaultTfSecret(context.Background(), client, VaultSecret{
 		Path:    "terraform/stage",
 		Version: 3,
 	}, mountData)
@@ -77,6 +79,41 @@ func TestGetVaultTfSecretV2(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestGetVaultTfSecretVersion(t *testing.T) {
+	mountData := map[string]string{
+		"terraform": KvV2,
+	}
+
+	mockedData := `
+	{
+		"data": {
+			"data": {
+				"foo": "bar"
+			},
+			"metadata": {
+				"version": 7
+			}
+		}
+	}`
+	vaultMock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("version"))
+		fmt.Fprint(w, dedent.Dedent(mockedData))
+	}))
+	defer vaultMock.Close()
+
+	client, _ := vault.NewClient(&vault.Config{
+		Address: vaultMock.URL,
+	})
+
+	actual, version, err := GetVaultTfSecretVersion(context.Background(), client, VaultSecret{
+		Path: "terraform/stage",
+	}, mountData)
+	assert.Nil(t, err)
+	assert.Equal(t, VaultKvData{"foo": "bar"}, actual)
+	// the latest version is resolved
+	assert.Equal(t, 7, version)
+}
+
 func TestGetVaultTfSecretV1(t *testing.T) {
 	mountData := map[string]string{
 		"terraform": KvV1,
@@ -101,7 +138,7 @@ func TestGetVaultTfSecretV1(t *testing.T) {
 		Address: vaultMock.URL,
 	})
 
-	actual, err := GetVaultTfSecret(client, VaultSecret{
+	actual, err := GetVaultTfSecret(context.Background(), client, VaultSecret{
 		Path:    "terraform/stage",
 		Version: 1,
 	}, mountData)
@@ -174,7 +211,7 @@ func TestWriteVaultOutputs(t *testing.T) {
 		"terraform": KvV1,
 	}
 
-	err := WriteOutputs(client, VaultSecret{
+	err := WriteOutputs(context.Background(), slog.New(slog.DiscardHandler), client, VaultSecret{
 		Path: "terraform/stage/outputs",
 	}, planOutput, mountData)
 
@@ -184,7 +221,7 @@ func TestWriteVaultOutputs(t *testing.T) {
 		"terraform": KvV2,
 	}
 
-	err = WriteOutputs(client, VaultSecret{
+	err = WriteOutputs(context.Background(), slog.New(slog.DiscardHandler), client, VaultSecret{
 		Path: "terraform/stage/outputs",
 	}, planOutput, mountData)
 